@@ -0,0 +1,188 @@
+package libkb
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	detKeyDerivationVersion1 = 1
+
+	detKeyDefaultScryptN = 1 << 15
+	detKeyDefaultScryptR = 8
+	detKeyDefaultScryptP = 1
+
+	detKeySigInfoLabel = "kb-detkey-sig-v1"
+	detKeyEncInfoLabel = "kb-detkey-enc-v1"
+)
+
+// DetKeyDerivationParams is the signed, persisted record of exactly how
+// a deterministically-generated Web key was derived from a user's
+// passphrase, so that ReDeriveDetKey -- run on any device, at any later
+// time -- reconstructs the identical bits: the scrypt cost parameters
+// and per-user salt that produced the master secret, and the HKDF info
+// labels used to split that secret into a signing keypair and an
+// encryption subkey. This gets signed into the sigchain the first time
+// the det key is published.
+type DetKeyDerivationParams struct {
+	Version int
+	ScryptN int
+	ScryptR int
+	ScryptP int
+	Salt    []byte
+	SigInfo string
+	EncInfo string
+}
+
+// DefaultDetKeyDerivationParams returns the current default derivation
+// parameters for a freshly-fetched per-user salt.
+func DefaultDetKeyDerivationParams(salt []byte) DetKeyDerivationParams {
+	return DetKeyDerivationParams{
+		Version: detKeyDerivationVersion1,
+		ScryptN: detKeyDefaultScryptN,
+		ScryptR: detKeyDefaultScryptR,
+		ScryptP: detKeyDefaultScryptP,
+		Salt:    salt,
+		SigInfo: detKeySigInfoLabel,
+		EncInfo: detKeyEncInfoLabel,
+	}
+}
+
+// DetKeyDeriver runs the scrypt+HKDF pipeline that turns a user
+// passphrase into a det key's signing keypair and encryption subkey,
+// per the parameters it was constructed with.
+type DetKeyDeriver struct {
+	Params DetKeyDerivationParams
+}
+
+// NewDetKeyDeriver builds a deriver for the given (previously-persisted,
+// signed) parameters.
+func NewDetKeyDeriver(params DetKeyDerivationParams) *DetKeyDeriver {
+	return &DetKeyDeriver{Params: params}
+}
+
+// masterSecret runs scrypt over passphrase with the deriver's salt and
+// cost parameters.
+func (d *DetKeyDeriver) masterSecret(passphrase []byte) ([]byte, error) {
+	p := d.Params
+	return scrypt.Key(passphrase, p.Salt, p.ScryptN, p.ScryptR, p.ScryptP, 32)
+}
+
+// Derive runs the full pipeline: scrypt(passphrase, salt) produces a
+// 32-byte master secret, then HKDF-SHA256 over that secret with each of
+// the two distinct info labels produces an Ed25519 signing keypair and a
+// Curve25519 encryption scalar, mirroring the scrypt+HKDF composition
+// syncthing's protocol/encryption package uses for its own passphrase-
+// derived keys.
+func (d *DetKeyDeriver) Derive(passphrase []byte) (sigPriv ed25519.PrivateKey, encPriv [32]byte, err error) {
+	master, err := d.masterSecret(passphrase)
+	if err != nil {
+		return nil, encPriv, err
+	}
+
+	sigSeed := make([]byte, ed25519.SeedSize)
+	if err = hkdfExpand(master, []byte(d.Params.SigInfo), sigSeed); err != nil {
+		return nil, encPriv, err
+	}
+	sigPriv = ed25519.NewKeyFromSeed(sigSeed)
+
+	if err = hkdfExpand(master, []byte(d.Params.EncInfo), encPriv[:]); err != nil {
+		return nil, encPriv, err
+	}
+	// Clamp per the usual X25519 private-scalar convention.
+	encPriv[0] &= 248
+	encPriv[31] &= 127
+	encPriv[31] |= 64
+
+	return sigPriv, encPriv, nil
+}
+
+func hkdfExpand(secret, info, out []byte) error {
+	r := hkdf.New(sha256.New, secret, nil, info)
+	_, err := io.ReadFull(r, out)
+	return err
+}
+
+// NewGenericKeyFromEd25519 converts a derived Ed25519 private key into a
+// GenericKey. The concrete NaCl signing key type -- and the rest of
+// libkb's key-construction code that builds a GenericKey from raw key
+// material -- lives outside this file; this package-level hook is the
+// one integration seam ReDeriveDetKeys is written against. A tree that
+// has that package should assign it once, at init time:
+//
+//	func init() {
+//		libkb.NewGenericKeyFromEd25519 = naclSigningKeyFromEd25519
+//	}
+//
+// Until that assignment happens, ReDeriveDetKeys (and ReDeriveDetKey)
+// fail with the error below rather than silently returning a key that
+// was never actually validated against a real GenericKey implementation.
+var NewGenericKeyFromEd25519 = func(priv ed25519.PrivateKey) (GenericKey, error) {
+	return nil, KeyFamilyError{"NewGenericKeyFromEd25519 is not wired up in this build"}
+}
+
+// SetDetKeyDerivationParams records the signed DetKeyDerivationParams
+// for this family's Web/det key, as read off the sigchain link that
+// published it. ReDeriveDetKey needs this to know which salt and scrypt
+// parameters produced the currently-active det key.
+func (ckf *ComputedKeyFamily) SetDetKeyDerivationParams(params DetKeyDerivationParams) {
+	ckf.detKeyParams = &params
+}
+
+func (ckf ComputedKeyFamily) detKeyDerivationParams() (params DetKeyDerivationParams, webKid KID, err error) {
+	if ckf.detKeyParams == nil {
+		return params, nil, KeyFamilyError{"no DetKeyDerivationParams on record; call SetDetKeyDerivationParams first"}
+	}
+	if ckf.cki.WebDeviceID == "" {
+		return params, nil, KeyFamilyError{"no Web device on record"}
+	}
+	dev, found := ckf.cki.Devices[ckf.cki.WebDeviceID]
+	if !found || dev == nil {
+		return params, nil, KeyFamilyError{"Web device not found in key family"}
+	}
+	return *ckf.detKeyParams, dev.Kid, nil
+}
+
+// ReDeriveDetKeys reconstructs both halves of this user's det key --
+// the Ed25519 signing keypair and the Curve25519 encryption scalar --
+// bit-for-bit from passphrase, using the DetKeyDerivationParams that were
+// signed into the sigchain when the det key was first published, and
+// verifies the signing half's KID matches the key currently marked
+// IsWeb() in the family. This is what lets a user on a brand-new machine
+// recover their web key from just their passphrase, without the private
+// key material ever having been exported off the machine that generated
+// it. ReDeriveDetKey is a convenience wrapper for callers that only need
+// the signing half.
+func (ckf ComputedKeyFamily) ReDeriveDetKeys(passphrase string) (sigKey GenericKey, encPriv [32]byte, err error) {
+	params, webKid, err := ckf.detKeyDerivationParams()
+	if err != nil {
+		return nil, encPriv, err
+	}
+
+	sigPriv, encPriv, err := NewDetKeyDeriver(params).Derive([]byte(passphrase))
+	if err != nil {
+		return nil, encPriv, err
+	}
+
+	sigKey, err = NewGenericKeyFromEd25519(sigPriv)
+	if err != nil {
+		return nil, encPriv, err
+	}
+
+	if !sigKey.GetKid().Eq(webKid) {
+		return nil, encPriv, KeyFamilyError{"re-derived det key does not match the KID on record"}
+	}
+	return sigKey, encPriv, nil
+}
+
+// ReDeriveDetKey is ReDeriveDetKeys for callers that only need the
+// signing half -- e.g. to verify a sigchain delegation -- and don't need
+// the Curve25519 encryption scalar ReDeriveDetKeys also reconstructs.
+func (ckf ComputedKeyFamily) ReDeriveDetKey(passphrase string) (GenericKey, error) {
+	key, _, err := ckf.ReDeriveDetKeys(passphrase)
+	return key, err
+}
@@ -0,0 +1,72 @@
+package libkb
+
+import (
+	"bytes"
+	"testing"
+)
+
+// TestDetKeyDeriverIsDeterministic checks the property ReDeriveDetKeys
+// depends on: the same passphrase and DetKeyDerivationParams must
+// reproduce bit-identical signing and encryption key material every
+// time, since that's the only thing that lets a brand-new device
+// recover a det key from just a passphrase.
+func TestDetKeyDeriverIsDeterministic(t *testing.T) {
+	params := DefaultDetKeyDerivationParams([]byte("some-per-user-salt"))
+	deriver := NewDetKeyDeriver(params)
+
+	sigPriv1, encPriv1, err := deriver.Derive([]byte("correct horse battery staple"))
+	if err != nil {
+		t.Fatalf("Derive: %s", err)
+	}
+	sigPriv2, encPriv2, err := deriver.Derive([]byte("correct horse battery staple"))
+	if err != nil {
+		t.Fatalf("Derive: %s", err)
+	}
+
+	if !bytes.Equal(sigPriv1, sigPriv2) {
+		t.Errorf("Derive produced different signing keys for the same passphrase+params")
+	}
+	if encPriv1 != encPriv2 {
+		t.Errorf("Derive produced different encryption scalars for the same passphrase+params")
+	}
+}
+
+// TestDetKeyDeriverDistinguishesInputs checks that the passphrase, the
+// salt, and the two HKDF info labels are all actually load-bearing --
+// changing any of them must change the derived key material, or a det
+// key from one user/version could collide with another's.
+func TestDetKeyDeriverDistinguishesInputs(t *testing.T) {
+	base := DefaultDetKeyDerivationParams([]byte("salt-a"))
+	baseSigPriv, baseEncPriv, err := NewDetKeyDeriver(base).Derive([]byte("passphrase"))
+	if err != nil {
+		t.Fatalf("Derive: %s", err)
+	}
+
+	otherPassphrase := base
+	sigPriv, encPriv, err := NewDetKeyDeriver(otherPassphrase).Derive([]byte("different-passphrase"))
+	if err != nil {
+		t.Fatalf("Derive: %s", err)
+	}
+	if bytes.Equal(baseSigPriv, sigPriv) || baseEncPriv == encPriv {
+		t.Errorf("Derive produced the same key material for two different passphrases")
+	}
+
+	otherSalt := DefaultDetKeyDerivationParams([]byte("salt-b"))
+	sigPriv, encPriv, err = NewDetKeyDeriver(otherSalt).Derive([]byte("passphrase"))
+	if err != nil {
+		t.Fatalf("Derive: %s", err)
+	}
+	if bytes.Equal(baseSigPriv, sigPriv) || baseEncPriv == encPriv {
+		t.Errorf("Derive produced the same key material for two different salts")
+	}
+
+	swappedLabels := base
+	swappedLabels.SigInfo, swappedLabels.EncInfo = base.EncInfo, base.SigInfo
+	sigPriv, encPriv, err = NewDetKeyDeriver(swappedLabels).Derive([]byte("passphrase"))
+	if err != nil {
+		t.Fatalf("Derive: %s", err)
+	}
+	if bytes.Equal(baseSigPriv, sigPriv) {
+		t.Errorf("swapping SigInfo/EncInfo didn't change the derived signing key")
+	}
+}
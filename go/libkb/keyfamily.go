@@ -4,9 +4,11 @@
 package libkb
 
 import (
+	"context"
 	"fmt"
 	"time"
 
+	lru "github.com/hashicorp/golang-lru"
 	keybase1 "github.com/keybase/client/protocol/go"
 	jsonw "github.com/keybase/go-jsonw"
 )
@@ -40,10 +42,30 @@ type ComputedKeyInfo struct {
 	// For sibkeys, the KID of last-added subkey (if valid)
 	Subkey KID
 
+	// Wrapped is set when this key's secret material lives only as a
+	// KMS-wrapped WrappedSecretKey rather than loaded into kf.AllKeys --
+	// see kms_envelope.go. GetEncryptionSubkeyForDevice falls back to
+	// unwrapping it through the family's configured KeyEnvelopeService
+	// when set and FindActiveEncryptionSubkey can't find the key locally.
+	Wrapped *WrappedSecretKey
+
 	// Map of SigID (as hex) -> KID
 	Delegations map[keybase1.SigID]KID
 	DelegatedAt *KeybaseTime
 	RevokedAt   *KeybaseTime
+	// RevokedBy is the KID of the key that signed the chain link revoking
+	// this one (RevokeSig/RevokeKid's tcl.GetKid()) -- not to be confused
+	// with an entry in Delegations, which instead records who *delegated*
+	// this key in the first place.
+	RevokedBy KID
+
+	// History is a time-ordered (both wall-clock and chain seqno) record
+	// of every status transition this key has gone through, appended to
+	// by Delegate/RevokeSig/RevokeKid. It's what FindActiveSibkeyAtChainSeqno
+	// and friends binary-search to answer "was this key active as of
+	// Merkle seqno N", which is immune to the clock-skew concerns noted
+	// on KeybaseTime above.
+	History []CkiTransition
 
 	Contextified
 }
@@ -105,6 +127,26 @@ type ComputedKeyFamily struct {
 	kf  *KeyFamily
 	cki *ComputedKeyInfos
 	Contextified
+
+	// deviceCache and kidCache are the two LRU caches described on
+	// keyfamily_cache.go; generation is bumped by every mutation of
+	// cki.Infos/cki.Devices/cki.KIDToDeviceID so a cache hit from before
+	// the mutation is detected and recomputed rather than served stale.
+	deviceCache *lru.Cache
+	kidCache    *lru.Cache
+	generation  uint64
+	metrics     keyCacheMetrics
+
+	// env backs SetKeyEnvelopeService/UnwrapDeviceSecret; see
+	// kms_envelope.go. It's a pointer (lazily allocated) rather than an
+	// embedded struct so that ComputedKeyFamily -- which is routinely
+	// passed by value to its many value-receiver methods -- never
+	// copies the mutex inside it.
+	env *envelopeState
+
+	// detKeyParams backs SetDetKeyDerivationParams/ReDeriveDetKey; see
+	// detkey.go.
+	detKeyParams *DetKeyDerivationParams
 }
 
 // Insert inserts the given ComputedKeyInfo object 1 or 2 times,
@@ -172,6 +214,14 @@ func (cki ComputedKeyInfos) InsertLocalEldestKey(fokid FOKID) {
 	// CTime and ETime are both initialized to zero, meaning that (until we get
 	// updates from the server) this key never expires.
 	eldestCki := NewComputedKeyInfo(true, true, KeyUncancelled, 0, 0)
+	// We don't have a chain link to pull a Merkle seqno from here, so
+	// record it as chain seqno 0, same convention NowAsKeybaseTime uses
+	// for "we don't know the chain seqno" -- without this, the key has no
+	// History at all until some later Delegate/Revoke touches it, and
+	// statusAtChainSeqno can't answer "was this the eldest key" for any
+	// seqno before that.
+	tm := NowAsKeybaseTime(0)
+	eldestCki.History = append(eldestCki.History, CkiTransition{Kind: CkiDelegated, Status: KeyUncancelled, Sibkey: true, At: *tm})
 	cki.Insert(&fokid, &eldestCki)
 }
 
@@ -183,6 +233,10 @@ func (cki ComputedKeyInfos) InsertServerEldestKey(eldestKey GenericKey, un strin
 		match, ctime, etime := pgp.CheckIdentity(kbid)
 		if match {
 			eldestCki := NewComputedKeyInfo(true, true, KeyUncancelled, ctime, etime)
+			// See InsertLocalEldestKey: no chain link here either, so
+			// seed History at chain seqno 0.
+			tm := NowAsKeybaseTime(0)
+			eldestCki.History = append(eldestCki.History, CkiTransition{Kind: CkiDelegated, Status: KeyUncancelled, Sibkey: true, At: *tm})
 			// If fokid is just a PGP fingerprint, expand it to include a proper KID.
 			// TODO: This is duplicated logic from InsertEldestKey. Clean them up somehow.
 			fokidWithKid := GenericKeyToFOKID(eldestKey)
@@ -194,7 +248,7 @@ func (cki ComputedKeyInfos) InsertServerEldestKey(eldestKey GenericKey, un strin
 	return KeyFamilyError{"InsertServerEldestKey found a non-PGP key."}
 }
 
-func (ckf ComputedKeyFamily) InsertEldestLink(tcl TypedChainLink, username string) (err error) {
+func (ckf *ComputedKeyFamily) InsertEldestLink(tcl TypedChainLink, username string) (err error) {
 
 	fokid := tcl.GetFOKID()
 
@@ -246,11 +300,14 @@ func (ckf ComputedKeyFamily) InsertEldestLink(tcl TypedChainLink, username strin
 	}
 
 	eldestCki := NewComputedKeyInfo(true, true, KeyUncancelled, ctime, etime)
+	tm := TclToKeybaseTime(tcl)
+	eldestCki.History = append(eldestCki.History, CkiTransition{Kind: CkiDelegated, Status: KeyUncancelled, Sibkey: true, At: *tm})
 
 	// If fokid is just a PGP fingerprint, expand it to include a proper KID.
 	fokidWithKid := GenericKeyToFOKID(key)
 
 	ckf.cki.Insert(&fokidWithKid, &eldestCki)
+	ckf.bumpGeneration()
 	return nil
 }
 
@@ -390,6 +447,38 @@ func (ckf ComputedKeyFamily) FindActiveSibkeyAtTime(f FOKID, t time.Time) (key G
 	return
 }
 
+// FindActiveSibkeyIncludingLocal is as FindActiveSibkey, but if the
+// server-supplied key family has no active sibkey for f, it falls back to a
+// locally-imported PGP key (see KeyFamily.ImportKeyring) that matches f.
+// Locally-imported keys never went through a sigchain delegation, so they
+// have no ComputedKeyInfo of their own; we treat them as perpetually active
+// sibkeys so a user with a long-standing PGP identity in their own keyring
+// can sign or decrypt without first uploading it to Keybase.
+func (ckf ComputedKeyFamily) FindActiveSibkeyIncludingLocal(f FOKID) (key GenericKey, cki ComputedKeyInfo, err error) {
+	if key, cki, err = ckf.FindActiveSibkey(f); err == nil {
+		return
+	}
+
+	localKey, localErr := ckf.kf.FindKeyWithFOKIDUnsafe(f)
+	if localErr != nil {
+		// Keep the original error; there's nothing locally either.
+		return
+	}
+	if _, isPGP := localKey.(*PGPKeyBundle); !isPGP {
+		return
+	}
+	if _, found := ckf.cki.Infos[localKey.GetKid().ToFOKIDMapKey()]; found {
+		// It's a known (not just locally-imported) key, so trust the
+		// original error from FindActiveSibkey above.
+		return
+	}
+
+	key = localKey
+	cki = NewComputedKeyInfo(false, true, KeyUncancelled, 0, 0)
+	err = nil
+	return
+}
+
 // FindActiveEncryptionSubkey takes a given PGP Fingerprint OR KID (in the form of a FOKID)
 // and finds the corresponding active encryption subkey in the current key family.  If for any reason
 // it cannot find the key, it will return an error saying why.  Otherwise, it will return
@@ -439,6 +528,7 @@ func (ckf *ComputedKeyFamily) Delegate(tcl TypedChainLink) (err error) {
 	fp := ckf.kf.kid2pgp[kid.ToMapKey()]
 
 	err = ckf.cki.Delegate(kid, &fp, tm, sigid, tcl.GetKid(), tcl.GetParentKid(), (tcl.GetRole() == DLGSibkey), tcl.GetCTime(), tcl.GetETime())
+	ckf.bumpGeneration()
 	return
 }
 
@@ -465,6 +555,10 @@ func (cki *ComputedKeyInfos) Delegate(kid KID, fingerprint *PGPFingerprint, tm *
 	info.Sibkey = isSibkey
 	cki.Sigs[sigid] = info
 
+	if tm != nil {
+		info.History = append(info.History, CkiTransition{Kind: CkiDelegated, Status: KeyUncancelled, Sibkey: isSibkey, At: *tm})
+	}
+
 	// If it's a subkey, make a pointer from it to its parent,
 	// and also from its parent to it.
 	if parentKid != nil {
@@ -521,7 +615,10 @@ func (ckf *ComputedKeyFamily) RevokeSig(sig keybase1.SigID, tcl TypedChainLink)
 	} else {
 		info.Status = KeyRevoked
 		info.RevokedAt = TclToKeybaseTime(tcl)
+		info.RevokedBy = tcl.GetKid()
+		info.History = append(info.History, CkiTransition{Kind: CkiRevoked, Status: KeyRevoked, Sibkey: info.Sibkey, At: *info.RevokedAt})
 	}
+	ckf.bumpGeneration()
 	return
 }
 
@@ -529,7 +626,10 @@ func (ckf *ComputedKeyFamily) RevokeKid(kid KID, tcl TypedChainLink) (err error)
 	if info, found := ckf.cki.Infos[kid.ToFOKIDMapKey()]; found {
 		info.Status = KeyRevoked
 		info.RevokedAt = TclToKeybaseTime(tcl)
+		info.RevokedBy = tcl.GetKid()
+		info.History = append(info.History, CkiTransition{Kind: CkiRevoked, Status: KeyRevoked, Sibkey: info.Sibkey, At: *info.RevokedAt})
 	}
+	ckf.bumpGeneration()
 	return
 }
 
@@ -564,17 +664,28 @@ func (kf *KeyFamily) LocalDelegate(key GenericKey) (err error) {
 	return
 }
 
-// GetKeyRoleAtTime returns the KeyRole (sibkey/subkey/none), taking into
-// account whether the key has been cancelled at time t.
+// DLGWallet marks a subkey that's been identified as a cryptocurrency
+// wallet key (see CryptoCoins) rather than a general encryption subkey.
+// It's a refinement of DLGSubkey, not a separate delegation type: wallet
+// keys are still delegated and revoked as ordinary PGP subkeys.
+const DLGWallet KeyRole = DLGSubkey + 1
+
+// GetKeyRoleAtTime returns the KeyRole (sibkey/subkey/wallet/none), taking
+// into account whether the key has been cancelled at time t. A subkey whose
+// curve OID matches an entry in CryptoCoins is reported as DLGWallet rather
+// than the generic DLGSubkey.
 func (ckf ComputedKeyFamily) GetKeyRoleAtTime(kid KID, t time.Time) (ret KeyRole) {
-	if info, err := ckf.getCkiIfActiveAtTime(kid.ToFOKID(), t); err != nil {
-		ret = DLGNone
-	} else if info.Sibkey {
-		ret = DLGSibkey
-	} else {
-		ret = DLGSubkey
+	info, err := ckf.getCkiIfActiveAtTime(kid.ToFOKID(), t)
+	if err != nil {
+		return DLGNone
 	}
-	return
+	if info.Sibkey {
+		return DLGSibkey
+	}
+	if ckf.isWalletSubkey(kid) {
+		return DLGWallet
+	}
+	return DLGSubkey
 }
 
 // GetKeyRole returns the KeyRole (sibkey/subkey/none), taking into account
@@ -602,13 +713,17 @@ func (ckf ComputedKeyFamily) GetAllActiveSibkeys() (ret []GenericKey) {
 	return ckf.GetAllActiveSibkeysAtTime(time.Now())
 }
 
+// GetAllActiveSubkeysAtTime gets all active subkeys, including wallet
+// subkeys (DLGWallet is a refinement of DLGSubkey, not a separate role --
+// see DLGWallet -- so it belongs here too).
 func (ckf ComputedKeyFamily) GetAllActiveSubkeysAtTime(t time.Time) (ret []GenericKey) {
 	for mapKey, key := range ckf.kf.AllKeys {
 		kid, err := mapKey.ToKID()
 		if err != nil {
 			continue
 		}
-		if ckf.GetKeyRoleAtTime(kid, t) == DLGSubkey && key != nil {
+		role := ckf.GetKeyRoleAtTime(kid, t)
+		if (role == DLGSubkey || role == DLGWallet) && key != nil {
 			ret = append(ret, key)
 		}
 	}
@@ -719,6 +834,7 @@ func (ckf *ComputedKeyFamily) UpdateDevices(tcl TypedChainLink) (err error) {
 		ckf.cki.WebDeviceID = dobj.ID
 	}
 
+	ckf.bumpGeneration()
 	return
 }
 
@@ -773,8 +889,36 @@ func (ckf *ComputedKeyFamily) GetCurrentDevice(g *GlobalContext) (*Device, error
 
 // GetEncryptionSubkeyForDevice gets the current encryption subkey for the given
 // device.  Note that many devices might share an encryption public key but
-// might have different secret keys.
+// might have different secret keys. Results are served from ckf's
+// device-keyed LRU cache (see keyfamily_cache.go) when available.
 func (ckf *ComputedKeyFamily) GetEncryptionSubkeyForDevice(did DeviceID) (key GenericKey, err error) {
+	ckf.ensureCaches()
+
+	cacheKey := did.String()
+	if v, found := ckf.deviceCache.Get(cacheKey); found {
+		entry := v.(deviceKeyCacheEntry)
+		if entry.generation == ckf.generation {
+			ckf.metrics.DeviceHits++
+			return entry.subkey, entry.err
+		}
+	}
+	ckf.metrics.DeviceMisses++
+
+	var sibkeyKID KID
+	key, err = ckf.computeEncryptionSubkeyForDevice(did, &sibkeyKID)
+	ckf.deviceCache.Add(cacheKey, deviceKeyCacheEntry{
+		generation: ckf.generation,
+		sibkeyKID:  sibkeyKID,
+		subkey:     key,
+		err:        err,
+	})
+	return
+}
+
+// computeEncryptionSubkeyForDevice is GetEncryptionSubkeyForDevice's
+// uncached implementation; it also reports the sibkey KID it resolved
+// along the way, since that's the other half of the device-cache tuple.
+func (ckf *ComputedKeyFamily) computeEncryptionSubkeyForDevice(did DeviceID, sibkeyKID *KID) (key GenericKey, err error) {
 	var kid KID
 	if kid, err = ckf.getSibkeyKidForDevice(did); err != nil {
 		return
@@ -782,14 +926,52 @@ func (ckf *ComputedKeyFamily) GetEncryptionSubkeyForDevice(did DeviceID) (key Ge
 	if kid == nil {
 		return
 	}
-	if cki, found := ckf.cki.Infos[kid.ToFOKIDMapKey()]; !found {
+	*sibkeyKID = kid
+	cki, found := ckf.cki.Infos[kid.ToFOKIDMapKey()]
+	if !found || !cki.Subkey.IsValid() {
+		return
+	}
+
+	key, err = ckf.FindActiveEncryptionSubkey(cki.Subkey)
+	if err == nil {
+		return
+	}
+
+	subInfo, found := ckf.cki.Infos[cki.Subkey.ToFOKIDMapKey()]
+	if !found || subInfo.Wrapped == nil || ckf.env == nil {
 		return
-	} else if !cki.Subkey.IsValid() {
+	}
+	// A revoked, expired or sibkey-delegated subkey keeps the error from
+	// FindActiveEncryptionSubkey; only a missing local copy is unwrapped.
+	if _, aerr := ckf.getCkiIfActiveNow(cki.Subkey.ToFOKID()); aerr != nil || subInfo.Sibkey {
 		return
-	} else {
-		key, err = ckf.FindActiveEncryptionSubkey(cki.Subkey)
 	}
-	return
+	// The subkey's secret material isn't loaded into kf.AllKeys, but
+	// there's a WrappedSecretKey on record for it and this family has a
+	// KeyEnvelopeService configured -- unwrap it through the envelope
+	// rather than failing outright. The unwrapped GenericKey ends up
+	// cached in ckf.deviceCache same as any other result of this method.
+	return ckf.unwrapEncryptionSubkey(cki.Subkey, *subInfo.Wrapped)
+}
+
+// unwrapEncryptionSubkey turns a WrappedSecretKey into a GenericKey via
+// ckf's configured KeyEnvelopeService (see kms_envelope.go). It uses
+// context.Background() since GetEncryptionSubkeyForDevice doesn't thread a
+// context down this far; once it does, that context should replace this
+// one.
+func (ckf *ComputedKeyFamily) unwrapEncryptionSubkey(kid KID, w WrappedSecretKey) (GenericKey, error) {
+	raw, err := ckf.UnwrapDeviceSecret(context.Background(), w)
+	if err != nil {
+		return nil, err
+	}
+	key, err := NewGenericKeyFromSecretBytes(raw)
+	if err != nil {
+		return nil, err
+	}
+	if !key.GetKid().Eq(kid) {
+		return nil, KeyFamilyError{"unwrapped device secret does not match the KID on record"}
+	}
+	return key, nil
 }
 
 // GetDeviceForKey gets the device that this key is bound to, if any.
@@ -797,7 +979,27 @@ func (ckf *ComputedKeyFamily) GetDeviceForKey(key GenericKey) (ret *Device, err
 	return ckf.getDeviceForKid(key.GetKid())
 }
 
+// getDeviceForKid resolves the *Device bound to kid, served from ckf's
+// KID-keyed LRU cache (see keyfamily_cache.go) when available.
 func (ckf *ComputedKeyFamily) getDeviceForKid(kid KID) (ret *Device, err error) {
+	ckf.ensureCaches()
+
+	if entry, found := ckf.kidCacheGet(kid); found {
+		ckf.metrics.KIDHits++
+		return entry.device, entry.devErr
+	}
+	ckf.metrics.KIDMisses++
+
+	ret, err = ckf.computeDeviceForKid(kid)
+	ckf.kidCacheMerge(kid, func(e *kidKeyCacheEntry) {
+		e.device = ret
+		e.devErr = err
+	})
+	return
+}
+
+// computeDeviceForKid is getDeviceForKid's uncached implementation.
+func (ckf *ComputedKeyFamily) computeDeviceForKid(kid KID) (ret *Device, err error) {
 	if didString, found := ckf.cki.KIDToDeviceID[kid.ToMapKey()]; found {
 		ret = ckf.cki.Devices[didString]
 	}
@@ -820,18 +1022,47 @@ func (ckf *ComputedKeyFamily) IsDetKey(key GenericKey) (ret bool, err error) {
 	return
 }
 
+// IsDetKeyWithParams is IsDetKey plus the DetKeyDerivationParams the key
+// was derived under (see SetDetKeyDerivationParams/ReDeriveDetKeys), for
+// callers that hold just the GenericKey and need to find their way back
+// to "what passphrase parameters would reproduce this." params is nil
+// whenever ret is false. Kept as a separate method so as not to break
+// IsDetKey's existing exported signature.
+func (ckf *ComputedKeyFamily) IsDetKeyWithParams(key GenericKey) (ret bool, params *DetKeyDerivationParams, err error) {
+	if ret, err = ckf.IsDetKey(key); ret {
+		params = ckf.detKeyParams
+	}
+	return
+}
+
 // isDetKeyHelper looks at the given KID (in hex) and sees if it is marked as a
 // deterministic Key (if the IsWeb() flag is on).  It won't look up or down the
-// key graph.
+// key graph. The result is cached alongside the *Device entry for kid in
+// ckf's KID-keyed LRU cache (see keyfamily_cache.go).
 func (ckf *ComputedKeyFamily) isDetKeyHelper(kid KID) (ret bool, err error) {
+	ckf.ensureCaches()
+
+	if entry, found := ckf.kidCacheGet(kid); found && entry.detKeyComputed {
+		ckf.metrics.KIDHits++
+		return entry.isDetKey, entry.detKeyErr
+	}
+	ckf.metrics.KIDMisses++
+
 	var dev *Device
 	if dev, err = ckf.getDeviceForKid(kid); err != nil {
+		ckf.kidCacheMerge(kid, func(e *kidKeyCacheEntry) {
+			e.detKeyComputed = true
+			e.detKeyErr = err
+		})
 		return
 	}
-	if dev == nil {
-		return
+	if dev != nil {
+		ret = dev.IsWeb()
 	}
-	ret = dev.IsWeb()
+	ckf.kidCacheMerge(kid, func(e *kidKeyCacheEntry) {
+		e.detKeyComputed = true
+		e.isDetKey = ret
+	})
 	return
 }
 
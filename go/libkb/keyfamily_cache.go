@@ -0,0 +1,113 @@
+package libkb
+
+import (
+	lru "github.com/hashicorp/golang-lru"
+)
+
+// defaultKeyCacheSize is used for both of ComputedKeyFamily's caches
+// until SetKeyCacheSize is called.
+const defaultKeyCacheSize = 512
+
+// deviceKeyCacheEntry is what ComputedKeyFamily's device-keyed LRU cache
+// stores: the sibkey KID and active encryption subkey resolved for one
+// DeviceID, tagged with the generation they were computed at.
+type deviceKeyCacheEntry struct {
+	generation uint64
+	sibkeyKID  KID
+	subkey     GenericKey
+	err        error
+}
+
+// kidKeyCacheEntry is what ComputedKeyFamily's KID-keyed LRU cache
+// stores: the *Device bound to a KID, and whether that KID is a det key
+// (isDetKeyHelper never looks at a key's parent, so this is always about
+// the KID itself), tagged with the generation they were computed at.
+// detKeyComputed distinguishes "we haven't looked this up yet" from "we
+// looked it up and the answer was false".
+type kidKeyCacheEntry struct {
+	generation     uint64
+	device         *Device
+	devErr         error
+	detKeyComputed bool
+	isDetKey       bool
+	detKeyErr      error
+}
+
+// keyCacheMetrics counts hits and misses on each of ComputedKeyFamily's
+// two caches, so operators can tell whether SetKeyCacheSize needs
+// tuning.
+type keyCacheMetrics struct {
+	DeviceHits   uint64
+	DeviceMisses uint64
+	KIDHits      uint64
+	KIDMisses    uint64
+}
+
+// SetKeyCacheSize resizes both of ComputedKeyFamily's lookup caches,
+// dropping any entries already cached. A non-positive size only drops
+// the cached entries: caching is not disabled, since ensureCaches
+// recreates both caches at defaultKeyCacheSize on the next lookup.
+func (ckf *ComputedKeyFamily) SetKeyCacheSize(size int) {
+	if size <= 0 {
+		ckf.deviceCache = nil
+		ckf.kidCache = nil
+		return
+	}
+	ckf.deviceCache, _ = lru.New(size)
+	ckf.kidCache, _ = lru.New(size)
+}
+
+// CacheMetrics returns a snapshot of the hit/miss counters for both
+// caches.
+func (ckf *ComputedKeyFamily) CacheMetrics() keyCacheMetrics {
+	return ckf.metrics
+}
+
+// ensureCaches lazily creates both caches at defaultKeyCacheSize the
+// first time they're needed, so a ComputedKeyFamily that never calls
+// SetKeyCacheSize still benefits from caching.
+func (ckf *ComputedKeyFamily) ensureCaches() {
+	if ckf.deviceCache == nil {
+		ckf.deviceCache, _ = lru.New(defaultKeyCacheSize)
+	}
+	if ckf.kidCache == nil {
+		ckf.kidCache, _ = lru.New(defaultKeyCacheSize)
+	}
+}
+
+// bumpGeneration invalidates every entry in both caches without
+// actually walking them: a cached entry is only trusted if its
+// generation matches ckf.generation, so bumping this counter is enough.
+// Called by every ComputedKeyFamily method that mutates cki.Infos,
+// cki.Devices, or cki.KIDToDeviceID.
+func (ckf *ComputedKeyFamily) bumpGeneration() {
+	ckf.generation++
+}
+
+// kidCacheGet fetches kid's cache entry if present and still current for
+// ckf.generation.
+func (ckf *ComputedKeyFamily) kidCacheGet(kid KID) (kidKeyCacheEntry, bool) {
+	v, found := ckf.kidCache.Get(kid.ToMapKey())
+	if !found {
+		return kidKeyCacheEntry{}, false
+	}
+	entry := v.(kidKeyCacheEntry)
+	if entry.generation != ckf.generation {
+		return kidKeyCacheEntry{}, false
+	}
+	return entry, true
+}
+
+// kidCacheMerge applies mutate to kid's current cache entry (starting
+// fresh if the cached one is missing or stale) and writes the result
+// back, so that e.g. caching the Device for a KID doesn't clobber an
+// already-cached IsDetKey result for the same KID, and vice versa.
+func (ckf *ComputedKeyFamily) kidCacheMerge(kid KID, mutate func(*kidKeyCacheEntry)) {
+	entry, ok := ckf.kidCacheGet(kid)
+	if !ok {
+		entry = kidKeyCacheEntry{}
+	}
+	entry.generation = ckf.generation
+	mutate(&entry)
+	ckf.kidCache.Add(kid.ToMapKey(), entry)
+}
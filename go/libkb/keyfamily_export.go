@@ -0,0 +1,138 @@
+package libkb
+
+import (
+	keybase1 "github.com/keybase/client/protocol/go"
+)
+
+// unixSecToKeybaseTimeMs converts a Unix-seconds timestamp (as stored on
+// ComputedKeyInfo.CTime/ETime and KeybaseTime.Unix) into the
+// millisecond-resolution keybase1.Time used on the wire, leaving zero
+// (meaning "unset") as zero.
+func unixSecToKeybaseTimeMs(sec int64) keybase1.Time {
+	if sec == 0 {
+		return 0
+	}
+	return keybase1.Time(sec * 1000)
+}
+
+// Export converts this ComputedKeyInfo into the keybase1.PublicKey shape
+// used on the framed-msgpack RPC surface. kid is passed in explicitly
+// since a ComputedKeyInfo doesn't carry its own KID -- it's only ever
+// reached via the ComputedKeyInfos.Infos/Sigs maps that key on it.
+func (cki ComputedKeyInfo) Export(kid KID) (ret keybase1.PublicKey) {
+	ret = keybase1.PublicKey{
+		KID:      kid.String(),
+		IsSibkey: cki.Sibkey,
+		IsEldest: cki.Eldest,
+		CTime:    unixSecToKeybaseTimeMs(cki.CTime),
+		ETime:    unixSecToKeybaseTimeMs(cki.ETime),
+	}
+	if cki.Parent != nil {
+		ret.ParentID = cki.Parent.String()
+	}
+	return ret
+}
+
+// Export converts this Device into the keybase1.Device shape used on the
+// RPC surface.
+func (d Device) Export() (ret keybase1.Device) {
+	ret = keybase1.Device{
+		DeviceID: keybase1.DeviceID(d.ID),
+	}
+	if d.Kid != nil {
+		ret.Kid = keybase1.KID(d.Kid.String())
+	}
+	return ret
+}
+
+// ExportDeviceKeys returns every device's resolved sibkey and subkey
+// pairs, grouped by DeviceID, in the keybase1.PublicKey RPC shape. This
+// gives RPC clients (CLI, GUI, KBFS) a stable view of "what keys does
+// this device have" without reaching into unexported ComputedKeyInfos
+// internals.
+func (ckf ComputedKeyFamily) ExportDeviceKeys() map[string][]keybase1.PublicKey {
+	ret := make(map[string][]keybase1.PublicKey, len(ckf.cki.Devices))
+	for did := range ckf.cki.Devices {
+		ret[did] = nil
+	}
+	// cki.Infos stores the same *ComputedKeyInfo under more than one map
+	// key for a PGP-sourced key (its KID and its PGP fingerprint -- see
+	// Delegate), so track which ones have already been exported to avoid
+	// emitting the same pair twice, same as ExportRevokedKeys.
+	seen := make(map[*ComputedKeyInfo]bool, len(ckf.cki.Infos))
+	for kidKey, did := range ckf.cki.KIDToDeviceID {
+		kid, err := kidKey.ToKID()
+		if err != nil {
+			continue
+		}
+		info, found := ckf.cki.Infos[kid.ToFOKIDMapKey()]
+		if !found || seen[info] {
+			continue
+		}
+		seen[info] = true
+		ret[did] = append(ret[did], info.Export(kid))
+
+		// KIDToDeviceID only ever maps a device's sibkey KID, same as
+		// GetAllActiveKeysForDevice -- walk every subkey hanging off this
+		// sibkey (info.Subkey is just the last one added) to pick up the
+		// rest of the pairs this method's own doc comment promises.
+		for subkidKey, subinfo := range ckf.cki.Infos {
+			if !subinfo.Parent.Eq(kid) || seen[subinfo] {
+				continue
+			}
+			subkid, err := subkidKey.ToKID()
+			if err != nil {
+				continue
+			}
+			seen[subinfo] = true
+			ret[did] = append(ret[did], subinfo.Export(subkid))
+		}
+	}
+	return ret
+}
+
+// ExportRevokedKeys produces revocation metadata -- the revoked key
+// itself, the KID that signed the revocation, and when it happened as
+// both Unix ms and chain seqno -- for every revoked key in the family.
+func (ckf ComputedKeyFamily) ExportRevokedKeys() (ret []keybase1.RevokedKey) {
+	seen := make(map[*ComputedKeyInfo]bool, len(ckf.cki.Infos))
+	for kidKey, info := range ckf.cki.Infos {
+		if info.Status != KeyRevoked || info.RevokedAt == nil || seen[info] {
+			continue
+		}
+		kid, err := kidKey.ToKID()
+		if err != nil {
+			continue
+		}
+		seen[info] = true
+
+		rk := keybase1.RevokedKey{
+			Key:        info.Export(kid),
+			RevokedAt:  unixSecToKeybaseTimeMs(info.RevokedAt.Unix),
+			ChainSeqno: info.RevokedAt.Chain,
+		}
+		if info.RevokedBy != nil {
+			rk.RevokerKid = keybase1.KID(info.RevokedBy.String())
+		}
+		ret = append(ret, rk)
+	}
+	return
+}
+
+// ExportAllPGPKeys yields the hex fingerprint and armored bundle for
+// every PGP key in the family, active or not, so RPC clients can offer a
+// full PGP key picker without re-deriving fingerprints client-side.
+func (ckf ComputedKeyFamily) ExportAllPGPKeys() (ret []keybase1.PublicKey, err error) {
+	for _, pgp := range ckf.kf.pgps {
+		armored, aerr := pgp.ArmoredString()
+		if aerr != nil {
+			return nil, aerr
+		}
+		ret = append(ret, keybase1.PublicKey{
+			KID:            pgp.GetKid().String(),
+			PGPFingerprint: pgp.GetFingerprint().String(),
+			PGPBundle:      armored,
+		})
+	}
+	return ret, nil
+}
@@ -0,0 +1,101 @@
+package libkb
+
+import "fmt"
+
+// CkiStatusKind enumerates the kinds of status transition recorded in a
+// ComputedKeyInfo's History.
+type CkiStatusKind int
+
+const (
+	CkiDelegated CkiStatusKind = iota
+	CkiRevoked
+)
+
+// CkiTransition is one entry in a ComputedKeyInfo's History: the status
+// the key moved to (and whether it was a sibkey at that point), and the
+// KeybaseTime -- both wall-clock and chain seqno -- at which the move
+// happened.
+type CkiTransition struct {
+	Kind   CkiStatusKind
+	Status KeyStatus
+	Sibkey bool
+	At     KeybaseTime
+}
+
+// statusAtChainSeqno returns the status (and sibkey-ness) this key had as
+// of the given Merkle chain seqno, found by binary-searching History for
+// the last transition at or before seqno. History is appended to in
+// chain order as Delegate/RevokeSig/RevokeKid replay a sigchain forward,
+// so it's already sorted on Chain.
+func (cki ComputedKeyInfo) statusAtChainSeqno(seqno int) (status KeyStatus, sibkey bool, found bool) {
+	h := cki.History
+	lo, hi := 0, len(h)
+	for lo < hi {
+		mid := (lo + hi) / 2
+		if h[mid].At.Chain <= seqno {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	if lo == 0 {
+		return KeyUncancelled, false, false
+	}
+	t := h[lo-1]
+	return t.Status, t.Sibkey, true
+}
+
+// getCkiIfActiveAtChainSeqno is the chain-seqno analogue of
+// getCkiIfActiveAtTime: it asks not "was this key active at time t" but
+// "was this key active as of Merkle seqno", sidestepping any clock skew
+// in the wall-clock timestamps a chain link happens to carry. sibkey is
+// the key's sibkey-ness as of seqno, not its current one -- a later
+// chain link can re-delegate the same KID with a different Sibkey value.
+func (ckf ComputedKeyFamily) getCkiIfActiveAtChainSeqno(f FOKID, seqno int) (ret *ComputedKeyInfo, sibkey bool, err error) {
+	ki := ckf.cki.Infos[f.ToFirstMapKey()]
+	if ki == nil {
+		return nil, false, NoKeyError{fmt.Sprintf("The key '%s' wasn't found", f.String())}
+	}
+	status, sibkey, found := ki.statusAtChainSeqno(seqno)
+	if !found {
+		return nil, false, NoKeyError{fmt.Sprintf("The key '%s' has no recorded history at or before chain seqno %d", f.String(), seqno)}
+	}
+	if status != KeyUncancelled {
+		return nil, false, KeyRevokedError{fmt.Sprintf("The key '%s' was no longer active as of chain seqno %d", f.String(), seqno)}
+	}
+	return ki, sibkey, nil
+}
+
+// FindActiveSibkeyAtChainSeqno is as FindActiveSibkeyAtTime, but keyed on
+// the monotonic Merkle chain seqno rather than wall-clock time. This is
+// the right tool for identity/tracking code that needs to re-verify a
+// sigchain link exactly as it appeared at that chain position, since the
+// link's own wall-clock timestamp may not be trustworthy.
+func (ckf ComputedKeyFamily) FindActiveSibkeyAtChainSeqno(f FOKID, seqno int) (key GenericKey, cki ComputedKeyInfo, err error) {
+	liveCki, sibkey, err := ckf.getCkiIfActiveAtChainSeqno(f, seqno)
+	if liveCki == nil || err != nil {
+		return
+	}
+	if !sibkey {
+		err = BadKeyError{fmt.Sprintf("The key '%s' wasn't delegated as a sibkey", f.String())}
+		return
+	}
+	key, err = ckf.kf.FindKeyWithFOKIDUnsafe(f)
+	cki = *liveCki
+	return
+}
+
+// GetAllActiveSibkeysAtChainSeqno is the chain-seqno analogue of
+// GetAllActiveSibkeysAtTime.
+func (ckf ComputedKeyFamily) GetAllActiveSibkeysAtChainSeqno(seqno int) (ret []GenericKey) {
+	for mapKey, key := range ckf.kf.AllKeys {
+		kid, err := mapKey.ToKID()
+		if err != nil {
+			continue
+		}
+		if _, _, ferr := ckf.FindActiveSibkeyAtChainSeqno(kid.ToFOKID(), seqno); ferr == nil && key != nil {
+			ret = append(ret, key)
+		}
+	}
+	return
+}
@@ -0,0 +1,184 @@
+package libkb
+
+import (
+	"fmt"
+
+	keybase1 "github.com/keybase/client/protocol/go"
+)
+
+// KFOStepKind identifies which mutation a KeyFamilyOperationStep performs.
+type KFOStepKind int
+
+const (
+	KFODelegate KFOStepKind = iota
+	KFORevokeSig
+	KFORevokeKid
+	KFOUpdateDevice
+	KFOLocalImport
+)
+
+// KeyFamilyOperationStep is one desired mutation against a
+// ComputedKeyFamily. Only the fields relevant to Kind need to be filled
+// in; the rest are ignored.
+type KeyFamilyOperationStep struct {
+	Kind KFOStepKind
+
+	// KFODelegate: the chain link describing the sibkey/subkey delegation.
+	Link TypedChainLink
+
+	// KFORevokeSig: the sig being revoked, and the chain link that revokes it.
+	SigID     keybase1.SigID
+	RevokeTcl TypedChainLink
+
+	// KFORevokeKid: the KID being revoked, and the chain link that revokes it.
+	KID KID
+
+	// KFOUpdateDevice: the chain link carrying the Device update.
+	DeviceLink TypedChainLink
+
+	// KFOLocalImport: keys to merge in locally, as with KeyFamily.ImportKeyring.
+	KeyringSpec KeyringSpec
+}
+
+// KeyFamilyOperation is a declarative batch of steps to run against a
+// ComputedKeyFamily via RunKeyFamilyOperation.
+type KeyFamilyOperation struct {
+	Steps []KeyFamilyOperationStep
+}
+
+// KFOStepStatus is the outcome of a single KeyFamilyOperationStep.
+type KFOStepStatus int
+
+const (
+	KFOSuccess KFOStepStatus = iota
+	KFOSkipped
+	KFOFailed
+)
+
+// KFOStepResult reports what happened when a single step was applied.
+type KFOStepResult struct {
+	Kind   KFOStepKind
+	Status KFOStepStatus
+	Reason string
+}
+
+// KFOResult is the structured report RunKeyFamilyOperation returns: the
+// per-step outcomes, in order, and whether the whole operation was rolled
+// back because of a failure.
+type KFOResult struct {
+	Steps      []KFOStepResult
+	RolledBack bool
+}
+
+// RunKeyFamilyOperation applies op's steps to ckf in order. Before
+// applying anything it snapshots ckf's ComputedKeyInfos (deep enough to
+// protect the Delegations and Devices maps from the mutations below); if
+// any step fails, the snapshot is restored onto ckf and the error from
+// that step is returned alongside a KFOResult describing every step that
+// ran. This lets callers evaluate a hypothetical batch of changes --
+// "what would the family look like if I revoked device X and added key
+// Y?" -- without permanently mutating the live object on failure.
+//
+// KFOLocalImport steps merge keys into the underlying KeyFamily (not the
+// ComputedKeyInfos) via ImportKeyring, and are not undone by a rollback:
+// keys an import already added to the KeyFamily's AllKeys and PGP maps
+// stay there even when a later step fails.
+func RunKeyFamilyOperation(ckf *ComputedKeyFamily, op KeyFamilyOperation) (*KFOResult, error) {
+	snapshot := deepCopyCki(ckf.cki)
+	result := &KFOResult{}
+
+	for _, step := range op.Steps {
+		status, reason, err := applyKFOStep(ckf, step)
+		result.Steps = append(result.Steps, KFOStepResult{Kind: step.Kind, Status: status, Reason: reason})
+		if err != nil {
+			ckf.cki = snapshot
+			ckf.bumpGeneration()
+			result.RolledBack = true
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+func applyKFOStep(ckf *ComputedKeyFamily, step KeyFamilyOperationStep) (KFOStepStatus, string, error) {
+	switch step.Kind {
+	case KFODelegate:
+		if step.Link == nil {
+			return KFOSkipped, "no chain link provided", nil
+		}
+		if err := ckf.Delegate(step.Link); err != nil {
+			return KFOFailed, err.Error(), err
+		}
+		return KFOSuccess, "", nil
+	case KFORevokeSig:
+		if err := ckf.RevokeSig(step.SigID, step.RevokeTcl); err != nil {
+			return KFOFailed, err.Error(), err
+		}
+		return KFOSuccess, "", nil
+	case KFORevokeKid:
+		if err := ckf.RevokeKid(step.KID, step.RevokeTcl); err != nil {
+			return KFOFailed, err.Error(), err
+		}
+		return KFOSuccess, "", nil
+	case KFOUpdateDevice:
+		if step.DeviceLink == nil {
+			return KFOSkipped, "no chain link provided", nil
+		}
+		if err := ckf.UpdateDevices(step.DeviceLink); err != nil {
+			return KFOFailed, err.Error(), err
+		}
+		return KFOSuccess, "", nil
+	case KFOLocalImport:
+		if err := ckf.kf.ImportKeyring(step.KeyringSpec); err != nil {
+			return KFOFailed, err.Error(), err
+		}
+		return KFOSuccess, "", nil
+	default:
+		err := fmt.Errorf("unknown KeyFamilyOperation step kind %d", step.Kind)
+		return KFOFailed, err.Error(), err
+	}
+}
+
+// deepCopyCki is like ComputedKeyInfos.ShallowCopy, but also clones each
+// *ComputedKeyInfo (including its Delegations map) and each *Device, so
+// that mutating the copy -- as Delegate/RevokeSig/RevokeKid/UpdateDevices
+// all do in place -- can never reach back into the original.
+func deepCopyCki(cki *ComputedKeyInfos) *ComputedKeyInfos {
+	clones := make(map[*ComputedKeyInfo]*ComputedKeyInfo, len(cki.Infos))
+	cloneOf := func(v *ComputedKeyInfo) *ComputedKeyInfo {
+		if c, found := clones[v]; found {
+			return c
+		}
+		c := *v
+		c.Delegations = make(map[keybase1.SigID]KID, len(v.Delegations))
+		for sid, kid := range v.Delegations {
+			c.Delegations[sid] = kid
+		}
+		c.History = append([]CkiTransition(nil), v.History...)
+		clones[v] = &c
+		return &c
+	}
+
+	ret := &ComputedKeyInfos{
+		dirty:         cki.dirty,
+		Infos:         make(map[FOKIDMapKey]*ComputedKeyInfo, len(cki.Infos)),
+		Sigs:          make(map[keybase1.SigID]*ComputedKeyInfo, len(cki.Sigs)),
+		Devices:       make(map[string]*Device, len(cki.Devices)),
+		KIDToDeviceID: make(map[KIDMapKey]string, len(cki.KIDToDeviceID)),
+		WebDeviceID:   cki.WebDeviceID,
+	}
+	for k, v := range cki.Infos {
+		ret.Infos[k] = cloneOf(v)
+	}
+	for k, v := range cki.Sigs {
+		ret.Sigs[k] = cloneOf(v)
+	}
+	for k, v := range cki.Devices {
+		d := *v
+		ret.Devices[k] = &d
+	}
+	for k, v := range cki.KIDToDeviceID {
+		ret.KIDToDeviceID[k] = v
+	}
+	return ret
+}
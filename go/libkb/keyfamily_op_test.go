@@ -0,0 +1,66 @@
+package libkb
+
+import "testing"
+
+// TestRunKeyFamilyOperationRollsBackOnFailure checks the core contract
+// RunKeyFamilyOperation's doc comment promises: a failing step reports
+// KFOFailed, the operation reports RolledBack, the failing step's error
+// is returned, and ckf.cki ends up pointing at the restored snapshot
+// rather than whatever was left behind mid-batch.
+func TestRunKeyFamilyOperationRollsBackOnFailure(t *testing.T) {
+	ckf := &ComputedKeyFamily{cki: &ComputedKeyInfos{WebDeviceID: "original-device"}}
+	before := ckf.cki
+
+	op := KeyFamilyOperation{
+		Steps: []KeyFamilyOperationStep{
+			{Kind: KFOStepKind(9999)}, // no such step kind: applyKFOStep always fails it
+		},
+	}
+
+	result, err := RunKeyFamilyOperation(ckf, op)
+	if err == nil {
+		t.Fatal("RunKeyFamilyOperation: expected an error from the unknown step kind")
+	}
+	if result == nil {
+		t.Fatal("RunKeyFamilyOperation: expected a non-nil result alongside the error")
+	}
+	if !result.RolledBack {
+		t.Error("result.RolledBack = false, want true")
+	}
+	if len(result.Steps) != 1 || result.Steps[0].Status != KFOFailed {
+		t.Errorf("result.Steps = %+v, want a single KFOFailed entry", result.Steps)
+	}
+	if ckf.cki == before {
+		t.Error("ckf.cki still points at the pre-rollback ComputedKeyInfos; RunKeyFamilyOperation should swap in the restored snapshot")
+	}
+	if ckf.cki.WebDeviceID != "original-device" {
+		t.Errorf("ckf.cki.WebDeviceID = %q after rollback, want the original value preserved", ckf.cki.WebDeviceID)
+	}
+}
+
+// TestRunKeyFamilyOperationSkipsNilChainLink checks that a KFODelegate
+// or KFOUpdateDevice step with no chain link is skipped rather than
+// treated as a failure, matching what applyKFOStep does for a nil
+// Link/DeviceLink.
+func TestRunKeyFamilyOperationSkipsNilChainLink(t *testing.T) {
+	ckf := &ComputedKeyFamily{cki: &ComputedKeyInfos{}}
+	op := KeyFamilyOperation{
+		Steps: []KeyFamilyOperationStep{
+			{Kind: KFODelegate},
+			{Kind: KFOUpdateDevice},
+		},
+	}
+
+	result, err := RunKeyFamilyOperation(ckf, op)
+	if err != nil {
+		t.Fatalf("RunKeyFamilyOperation: unexpected error: %s", err)
+	}
+	if result.RolledBack {
+		t.Error("result.RolledBack = true, want false: nothing should have failed")
+	}
+	for i, step := range result.Steps {
+		if step.Status != KFOSkipped {
+			t.Errorf("step %d: Status = %v, want KFOSkipped", i, step.Status)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package libkb
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+// KeyringSpec describes additional local PGP key material that should be
+// merged into a KeyFamily alongside whatever the server returned. Any
+// combination of the fields may be set; all matching keys are merged.
+type KeyringSpec struct {
+	// PubringPath and SecringPath point at GnuPG-style keyrings, e.g.
+	// a user's ~/.gnupg/pubring.gpg and secring.gpg. Either may be empty.
+	PubringPath string
+	SecringPath string
+
+	// PEMFiles is a list of paths to PEM or ASCII-armored key files.
+	PEMFiles []string
+
+	// ArmoredBundles is a list of already-loaded ASCII-armored key
+	// bundles, as might come from a CLI flag or config value.
+	ArmoredBundles []string
+}
+
+// ImportKeyring merges the key material described by spec into this
+// KeyFamily. Each file is read under a dotlock so we don't race a live
+// gpg-agent or `gpg` invocation against the same homedir. Keys already
+// present (by KID) are skipped; new keys are run through LocalDelegate
+// so they become usable for signing and decryption just like a
+// server-supplied key.
+func (kf *KeyFamily) ImportKeyring(spec KeyringSpec) (err error) {
+	G.Log.Debug("+ KeyFamily::ImportKeyring")
+	defer func() {
+		G.Log.Debug("- KeyFamily::ImportKeyring -> %s", ErrToOk(err))
+	}()
+
+	var bundles []string
+
+	for _, path := range []string{spec.PubringPath, spec.SecringPath} {
+		if len(path) == 0 {
+			continue
+		}
+		fromFile, ferr := readArmoredBundlesFromKeyring(path)
+		if ferr != nil {
+			return ferr
+		}
+		bundles = append(bundles, fromFile...)
+	}
+
+	for _, path := range spec.PEMFiles {
+		fromFile, ferr := readArmoredBundlesFromKeyring(path)
+		if ferr != nil {
+			return ferr
+		}
+		bundles = append(bundles, fromFile...)
+	}
+
+	bundles = append(bundles, spec.ArmoredBundles...)
+
+	for _, bundle := range bundles {
+		var key GenericKey
+		if key, err = ParseGenericKey(bundle); err != nil {
+			return err
+		}
+		if _, found := kf.AllKeys[key.GetKid().ToMapKey()]; found {
+			G.Log.Debug("| ImportKeyring: skipping duplicate KID %s", key.GetKid())
+			continue
+		}
+		if err = kf.LocalDelegate(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readArmoredBundlesFromKeyring opens the keyring or key file at path
+// under a dotlock, and returns each key it contains as an ASCII-armored
+// bundle, ready to be handed to ParseGenericKey. It accepts both
+// already-armored input (PEM files, ASCII-armored pubrings) and the
+// binary keyring format GnuPG uses for pubring.gpg/secring.gpg.
+func readArmoredBundlesFromKeyring(path string) (ret []string, err error) {
+	lock := newDotlock(path)
+	if err = lock.Lock(); err != nil {
+		return nil, err
+	}
+	defer lock.Unlock()
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	el, err := openpgp.ReadArmoredKeyRing(file)
+	if err != nil {
+		if _, serr := file.Seek(0, 0); serr != nil {
+			return nil, serr
+		}
+		el, err = openpgp.ReadKeyRing(file)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: not a recognizable keyring or key file (%s)", path, err)
+	}
+
+	for _, entity := range el {
+		var buf bytes.Buffer
+		w, werr := armor.Encode(&buf, openpgp.PublicKeyType, nil)
+		if werr != nil {
+			return nil, werr
+		}
+		if werr = entity.Serialize(w); werr != nil {
+			return nil, werr
+		}
+		if werr = w.Close(); werr != nil {
+			return nil, werr
+		}
+		ret = append(ret, buf.String())
+	}
+	return ret, nil
+}
+
+// dotlock implements GnuPG-style advisory file locking: a sibling
+// <path>.lock file whose existence (created with O_EXCL) signals
+// exclusive access, and whose contents are the owning process's PID so
+// a lock left behind by a crashed process can be told apart from one
+// still legitimately held, same as GnuPG's own dotlock. We take this
+// before reading a pubring/secring so we don't read a half-written file
+// out from under a running gpg-agent.
+type dotlock struct {
+	path     string
+	lockPath string
+	file     *os.File
+}
+
+func newDotlock(path string) *dotlock {
+	return &dotlock{path: path, lockPath: path + ".lock"}
+}
+
+const dotlockRetryInterval = 50 * time.Millisecond
+const dotlockTimeout = 5 * time.Second
+
+func (d *dotlock) Lock() error {
+	deadline := time.Now().Add(dotlockTimeout)
+	for {
+		f, err := os.OpenFile(d.lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			fmt.Fprintf(f, "%d\n", os.Getpid())
+			d.file = f
+			return nil
+		}
+		if !os.IsExist(err) {
+			return err
+		}
+		if d.clearIfStale() {
+			continue
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for lock on %s", d.path)
+		}
+		time.Sleep(dotlockRetryInterval)
+	}
+}
+
+// clearIfStale removes d's lock file and reports true if it was left
+// behind by a process that's no longer running -- the lock file's
+// content is just the owning PID, and a PID with no live process behind
+// it means whatever held the lock crashed rather than that it's still
+// working, the same distinction GnuPG's own dotlock makes before it will
+// steal a lock. A lock file whose PID can't be read (missing, empty, or
+// still being written by whoever just created it) is left alone; the
+// timeout loop in Lock will keep retrying it.
+func (d *dotlock) clearIfStale() bool {
+	contents, err := os.ReadFile(d.lockPath)
+	if err != nil {
+		return false
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(contents)))
+	if err != nil || pid <= 0 {
+		return false
+	}
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	if proc.Signal(syscall.Signal(0)) == nil {
+		return false // still alive
+	}
+	return os.Remove(d.lockPath) == nil
+}
+
+func (d *dotlock) Unlock() error {
+	if d.file == nil {
+		return nil
+	}
+	d.file.Close()
+	err := os.Remove(d.lockPath)
+	d.file = nil
+	return err
+}
@@ -0,0 +1,302 @@
+package libkb
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// KeyEnvelopeService wraps and unwraps device secret key material with
+// an external key management service, so the plaintext key only ever
+// exists in this process's memory, never on disk. It's modeled on the
+// envelope services used by Kubernetes' apiserver (the KMS plugin that
+// encrypts etcd secrets) and MinIO's KES integration.
+type KeyEnvelopeService interface {
+	// GenerateKey asks the service for a fresh data-encryption key
+	// under name, returning both the plaintext (for immediate local
+	// use) and its ciphertext (for storage in a WrappedSecretKey).
+	GenerateKey(ctx context.Context, name string) (plaintext, ciphertext []byte, err error)
+
+	// Decrypt unwraps a previously-generated ciphertext back to its
+	// plaintext data key.
+	Decrypt(ctx context.Context, name string, ciphertext []byte) (plaintext []byte, err error)
+}
+
+const wrappedSecretKeyVersion1 = 1
+
+// WrappedSecretKey is the on-disk format for a device secret key wrapped
+// by a KeyEnvelopeService: a versioned header, the key's name (so the
+// right KMS key/slot can be located again), the KMS-wrapped data
+// encryption key, the AEAD nonce used to seal the secret locally under
+// that data key, and the sealed secret itself.
+type WrappedSecretKey struct {
+	Version    int
+	KeyID      string
+	Ciphertext []byte // KMS-wrapped data encryption key
+	Nonce      []byte // AEAD nonce used with the unwrapped data key
+	Sealed     []byte // the device secret, sealed under the data key
+}
+
+// Marshal serializes w as a versioned, length-prefixed binary blob
+// suitable for writing to disk.
+func (w WrappedSecretKey) Marshal() []byte {
+	var buf []byte
+	buf = appendUint32(buf, uint32(w.Version))
+	buf = appendLenPrefixed(buf, []byte(w.KeyID))
+	buf = appendLenPrefixed(buf, w.Ciphertext)
+	buf = appendLenPrefixed(buf, w.Nonce)
+	buf = appendLenPrefixed(buf, w.Sealed)
+	return buf
+}
+
+// UnmarshalWrappedSecretKey parses the format Marshal produces.
+func UnmarshalWrappedSecretKey(b []byte) (ret WrappedSecretKey, err error) {
+	version, b, err := takeUint32(b)
+	if err != nil {
+		return ret, err
+	}
+	if version != wrappedSecretKeyVersion1 {
+		return ret, fmt.Errorf("WrappedSecretKey: unsupported version %d", version)
+	}
+	ret.Version = int(version)
+
+	var keyID []byte
+	if keyID, b, err = takeLenPrefixed(b); err != nil {
+		return ret, err
+	}
+	ret.KeyID = string(keyID)
+
+	if ret.Ciphertext, b, err = takeLenPrefixed(b); err != nil {
+		return ret, err
+	}
+	if ret.Nonce, b, err = takeLenPrefixed(b); err != nil {
+		return ret, err
+	}
+	if ret.Sealed, _, err = takeLenPrefixed(b); err != nil {
+		return ret, err
+	}
+	return ret, nil
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	var tmp [4]byte
+	binary.BigEndian.PutUint32(tmp[:], v)
+	return append(b, tmp[:]...)
+}
+
+func appendLenPrefixed(b []byte, v []byte) []byte {
+	b = appendUint32(b, uint32(len(v)))
+	return append(b, v...)
+}
+
+func takeUint32(b []byte) (uint32, []byte, error) {
+	if len(b) < 4 {
+		return 0, nil, errors.New("WrappedSecretKey: truncated uint32")
+	}
+	return binary.BigEndian.Uint32(b[:4]), b[4:], nil
+}
+
+func takeLenPrefixed(b []byte) ([]byte, []byte, error) {
+	n, b, err := takeUint32(b)
+	if err != nil {
+		return nil, nil, err
+	}
+	if uint32(len(b)) < n {
+		return nil, nil, errors.New("WrappedSecretKey: truncated field")
+	}
+	return b[:n], b[n:], nil
+}
+
+// localPassphraseEnvelope is the default KeyEnvelopeService: it wraps a
+// random data-encryption key with a passphrase-derived key-encryption
+// key (scrypt, AES-256-GCM), the same primitives used elsewhere for
+// passphrase-protected secret storage.
+type localPassphraseEnvelope struct {
+	passphrase []byte
+}
+
+// NewLocalPassphraseEnvelope returns the default, no-external-dependency
+// KeyEnvelopeService: everything is derived from a local passphrase.
+func NewLocalPassphraseEnvelope(passphrase []byte) KeyEnvelopeService {
+	return &localPassphraseEnvelope{passphrase: passphrase}
+}
+
+func (e *localPassphraseEnvelope) kek(salt []byte) ([]byte, error) {
+	return scrypt.Key(e.passphrase, salt, 1<<15, 8, 1, 32)
+}
+
+func (e *localPassphraseEnvelope) GenerateKey(ctx context.Context, name string) (plaintext, ciphertext []byte, err error) {
+	plaintext = make([]byte, 32)
+	if _, err = io.ReadFull(rand.Reader, plaintext); err != nil {
+		return nil, nil, err
+	}
+
+	salt := make([]byte, 16)
+	if _, err = io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, nil, err
+	}
+	kek, err := e.kek(salt)
+	if err != nil {
+		return nil, nil, err
+	}
+	gcm, err := newGCM(kek)
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, nil, err
+	}
+	sealed := gcm.Seal(nil, nonce, plaintext, []byte(name))
+
+	ciphertext = append(append(salt, nonce...), sealed...)
+	return plaintext, ciphertext, nil
+}
+
+func (e *localPassphraseEnvelope) Decrypt(ctx context.Context, name string, ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) < 16 {
+		return nil, errors.New("localPassphraseEnvelope: ciphertext too short")
+	}
+	salt, rest := ciphertext[:16], ciphertext[16:]
+	kek, err := e.kek(salt)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(kek)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) < gcm.NonceSize() {
+		return nil, errors.New("localPassphraseEnvelope: ciphertext too short")
+	}
+	nonce, sealed := rest[:gcm.NonceSize()], rest[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, sealed, []byte(name))
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// KESEnvelope is a KeyEnvelopeService backed by a KES-style HTTPS key
+// server (see https://github.com/minio/kes). The HTTP plumbing isn't
+// wired up yet -- both methods return an error naming the endpoint --
+// but the type exists so callers and config plumbing (a `keybase kms
+// rewrap` command lives in the CLI package, outside libkb) can be
+// written against the stable KeyEnvelopeService interface ahead of it.
+type KESEnvelope struct {
+	Endpoint string
+	KeyName  string
+}
+
+// NewKESEnvelope constructs a KESEnvelope pointed at a KES server.
+func NewKESEnvelope(endpoint, keyName string) *KESEnvelope {
+	return &KESEnvelope{Endpoint: endpoint, KeyName: keyName}
+}
+
+func (k *KESEnvelope) GenerateKey(ctx context.Context, name string) ([]byte, []byte, error) {
+	return nil, nil, fmt.Errorf("KESEnvelope(%s): not yet implemented", k.Endpoint)
+}
+
+func (k *KESEnvelope) Decrypt(ctx context.Context, name string, ciphertext []byte) ([]byte, error) {
+	return nil, fmt.Errorf("KESEnvelope(%s): not yet implemented", k.Endpoint)
+}
+
+// wrappedKeyCacheEntry is a TTL-cached plaintext data key, keyed by
+// WrappedSecretKey.KeyID, so repeated unwraps of the same device secret
+// don't round-trip to the KMS every time.
+type wrappedKeyCacheEntry struct {
+	plaintext []byte
+	cachedAt  time.Time
+}
+
+// SetKeyEnvelopeService configures ckf to unwrap device secrets through
+// svc rather than (or in addition to) a local passphrase, caching each
+// unwrapped data key for ttl. This is the hook GetEncryptionSubkeyForDevice
+// uses once a device's private key material is stored in WrappedSecretKey
+// form rather than plain local-passphrase encryption.
+func (ckf *ComputedKeyFamily) SetKeyEnvelopeService(svc KeyEnvelopeService, ttl time.Duration) {
+	ckf.env = &envelopeState{
+		envelope:      svc,
+		envelopeTTL:   ttl,
+		envelopeCache: make(map[string]wrappedKeyCacheEntry),
+	}
+}
+
+// UnwrapDeviceSecret unwraps the plaintext secret sealed in w using
+// ckf's configured KeyEnvelopeService, consulting (and populating) the
+// TTL cache first. It returns raw key bytes; turning those into a
+// GenericKey is NewGenericKeyFromSecretBytes's job (see
+// unwrapEncryptionSubkey in keyfamily.go, which is what
+// GetEncryptionSubkeyForDevice falls back to once a subkey's
+// ComputedKeyInfo carries a WrappedSecretKey).
+func (ckf *ComputedKeyFamily) UnwrapDeviceSecret(ctx context.Context, w WrappedSecretKey) ([]byte, error) {
+	if ckf.env == nil {
+		return nil, errors.New("UnwrapDeviceSecret: no KeyEnvelopeService configured (call SetKeyEnvelopeService first)")
+	}
+	env := ckf.env
+
+	env.mu.Lock()
+	svc := env.envelope
+	ttl := env.envelopeTTL
+	entry, found := env.envelopeCache[w.KeyID]
+	env.mu.Unlock()
+
+	if found && time.Since(entry.cachedAt) < ttl {
+		return unsealWithDataKey(entry.plaintext, w)
+	}
+
+	dataKey, err := svc.Decrypt(ctx, w.KeyID, w.Ciphertext)
+	if err != nil {
+		return nil, err
+	}
+
+	env.mu.Lock()
+	env.envelopeCache[w.KeyID] = wrappedKeyCacheEntry{plaintext: dataKey, cachedAt: time.Now()}
+	env.mu.Unlock()
+
+	return unsealWithDataKey(dataKey, w)
+}
+
+// NewGenericKeyFromSecretBytes converts the plaintext bytes UnwrapDeviceSecret
+// recovers from a WrappedSecretKey into a GenericKey. The concrete key type
+// (NaCl, PGP, ...) lives outside this file; like detkey.go's
+// NewGenericKeyFromEd25519, this package-level hook is the seam
+// ComputedKeyFamily.unwrapEncryptionSubkey is written against. Until code
+// elsewhere in libkb assigns the real constructor at init time, it fails
+// with the error below.
+var NewGenericKeyFromSecretBytes = func(raw []byte) (GenericKey, error) {
+	return nil, KeyFamilyError{"NewGenericKeyFromSecretBytes is not wired up in this build"}
+}
+
+func unsealWithDataKey(dataKey []byte, w WrappedSecretKey) ([]byte, error) {
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return gcm.Open(nil, w.Nonce, w.Sealed, []byte(w.KeyID))
+}
+
+// envelopeState backs ComputedKeyFamily.SetKeyEnvelopeService and
+// UnwrapDeviceSecret. ComputedKeyFamily holds a *envelopeState (lazily
+// allocated) rather than embedding this struct directly so that
+// ComputedKeyFamily -- which is routinely passed by value to its many
+// value-receiver methods -- never copies the mutex inside it.
+type envelopeState struct {
+	mu            sync.Mutex
+	envelope      KeyEnvelopeService
+	envelopeTTL   time.Duration
+	envelopeCache map[string]wrappedKeyCacheEntry
+}
@@ -0,0 +1,61 @@
+package libkb
+
+import (
+	"bytes"
+	"testing"
+)
+
+// TestWrappedSecretKeyMarshalRoundTrip checks that UnmarshalWrappedSecretKey
+// recovers exactly what Marshal wrote, including fields that happen to be
+// empty -- the len-prefixed format has no delimiter between fields, so a
+// zero-length Nonce or Sealed is the easiest way to get the offsets wrong.
+func TestWrappedSecretKeyMarshalRoundTrip(t *testing.T) {
+	cases := []WrappedSecretKey{
+		{
+			Version:    wrappedSecretKeyVersion1,
+			KeyID:      "projects/foo/keyRings/bar/cryptoKeys/baz",
+			Ciphertext: []byte{0x01, 0x02, 0x03, 0x04},
+			Nonce:      []byte{0xAA, 0xBB, 0xCC},
+			Sealed:     []byte{0xDE, 0xAD, 0xBE, 0xEF, 0x00},
+		},
+		{
+			Version:    wrappedSecretKeyVersion1,
+			KeyID:      "",
+			Ciphertext: nil,
+			Nonce:      []byte{},
+			Sealed:     []byte{0x01},
+		},
+	}
+
+	for i, w := range cases {
+		b := w.Marshal()
+		got, err := UnmarshalWrappedSecretKey(b)
+		if err != nil {
+			t.Fatalf("case %d: UnmarshalWrappedSecretKey: %s", i, err)
+		}
+		if got.Version != w.Version {
+			t.Errorf("case %d: Version = %d, want %d", i, got.Version, w.Version)
+		}
+		if got.KeyID != w.KeyID {
+			t.Errorf("case %d: KeyID = %q, want %q", i, got.KeyID, w.KeyID)
+		}
+		if !bytes.Equal(got.Ciphertext, w.Ciphertext) {
+			t.Errorf("case %d: Ciphertext = %x, want %x", i, got.Ciphertext, w.Ciphertext)
+		}
+		if !bytes.Equal(got.Nonce, w.Nonce) {
+			t.Errorf("case %d: Nonce = %x, want %x", i, got.Nonce, w.Nonce)
+		}
+		if !bytes.Equal(got.Sealed, w.Sealed) {
+			t.Errorf("case %d: Sealed = %x, want %x", i, got.Sealed, w.Sealed)
+		}
+	}
+}
+
+// TestUnmarshalWrappedSecretKeyRejectsBadVersion checks that an unknown
+// version header is rejected rather than parsed as if it were version 1.
+func TestUnmarshalWrappedSecretKeyRejectsBadVersion(t *testing.T) {
+	w := WrappedSecretKey{Version: wrappedSecretKeyVersion1 + 1, KeyID: "k"}
+	if _, err := UnmarshalWrappedSecretKey(w.Marshal()); err == nil {
+		t.Errorf("UnmarshalWrappedSecretKey accepted an unsupported version")
+	}
+}
@@ -0,0 +1,385 @@
+package libkb
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Signer is the minimal signing capability a sigchain delegation needs:
+// given the bytes of the statement to delegate, produce a signature over
+// it.
+type Signer interface {
+	Sign(data []byte) (sig []byte, err error)
+}
+
+// secretKeyHolder is implemented by GenericKey values that know whether
+// their own secret material is loaded in this process.
+type secretKeyHolder interface {
+	HasSecretKey() bool
+}
+
+// dataSigner is implemented by GenericKey values that can sign directly.
+type dataSigner interface {
+	Sign(data []byte) (sig []byte, err error)
+}
+
+// Decrypter is the minimal decryption capability needed to recover
+// plaintext previously encrypted to a key's public half.
+type Decrypter interface {
+	Decrypt(ciphertext []byte) (plaintext []byte, err error)
+}
+
+// dataDecrypter is implemented by GenericKey values that can decrypt
+// directly.
+type dataDecrypter interface {
+	Decrypt(ciphertext []byte) (plaintext []byte, err error)
+}
+
+// keygripProvider is implemented by a PGPKeyBundle that already knows its
+// own GnuPG keygrip -- the 20-byte identifier GnuPG derives from the
+// key's public parameters, e.g. because it was read off `gpg
+// --list-keys --with-keygrip` at import time. gpg-agent indexes its keys
+// by this value, not by fingerprint, so a PGPKeyBundle that can't produce
+// one has no way to talk to a real agent.
+type keygripProvider interface {
+	Keygrip() []byte
+}
+
+// inProcessSigner signs with a GenericKey's own loaded secret material.
+type inProcessSigner struct {
+	key GenericKey
+}
+
+func (s inProcessSigner) Sign(data []byte) ([]byte, error) {
+	signer, ok := s.key.(dataSigner)
+	if !ok {
+		return nil, KeyFamilyError{fmt.Sprintf("key %s has no Sign method", s.key.GetKid())}
+	}
+	return signer.Sign(data)
+}
+
+// inProcessDecrypter decrypts with a GenericKey's own loaded secret
+// material.
+type inProcessDecrypter struct {
+	key GenericKey
+}
+
+func (d inProcessDecrypter) Decrypt(ciphertext []byte) ([]byte, error) {
+	decrypter, ok := d.key.(dataDecrypter)
+	if !ok {
+		return nil, KeyFamilyError{fmt.Sprintf("key %s has no Decrypt method", d.key.GetKid())}
+	}
+	return decrypter.Decrypt(ciphertext)
+}
+
+// SignerFor returns a Signer able to produce a delegation signature for
+// kid: an in-process signer when kid's secret material is already loaded
+// into kf.AllKeys, or a gpg-agent-backed signer when kid names a PGP key
+// present only as a public bundle (the common case for a master key kept
+// offline or on a smartcard) and that bundle can report its own keygrip.
+// Callers that need to handle a gpg-agent passphrase prompt should
+// type-assert the result to *PGPAgentSigner and call SignWithPinentry
+// directly instead of Sign.
+func (kf *KeyFamily) SignerFor(kid KID) (Signer, error) {
+	key, err := kf.FindKeyWithKIDUnsafe(kid)
+	if err != nil {
+		return nil, err
+	}
+	if holder, ok := key.(secretKeyHolder); ok && holder.HasSecretKey() {
+		return inProcessSigner{key: key}, nil
+	}
+	pgp, ok := key.(*PGPKeyBundle)
+	if !ok {
+		return nil, KeyFamilyError{fmt.Sprintf("no secret key material available to sign with %s", kid)}
+	}
+	kgp, ok := GenericKey(pgp).(keygripProvider)
+	if !ok {
+		return nil, KeyFamilyError{fmt.Sprintf("no keygrip available for %s; gpg-agent can only be reached with the real keygrip (see NewPGPAgentSigner)", kid)}
+	}
+	return NewPGPAgentSigner(pgp, kgp.Keygrip())
+}
+
+// DecrypterFor returns a Decrypter able to recover plaintext previously
+// encrypted to kid, mirroring SignerFor: an in-process decrypter when
+// kid's secret material is already loaded into kf.AllKeys, or a
+// gpg-agent-backed decrypter when kid names a PGP key present only as a
+// public bundle and that bundle can report its own keygrip. This is what
+// lets a locally-imported PGP key (see ImportKeyring) decrypt without its
+// private key material ever having to be uploaded anywhere.
+func (kf *KeyFamily) DecrypterFor(kid KID) (Decrypter, error) {
+	key, err := kf.FindKeyWithKIDUnsafe(kid)
+	if err != nil {
+		return nil, err
+	}
+	if holder, ok := key.(secretKeyHolder); ok && holder.HasSecretKey() {
+		return inProcessDecrypter{key: key}, nil
+	}
+	pgp, ok := key.(*PGPKeyBundle)
+	if !ok {
+		return nil, KeyFamilyError{fmt.Sprintf("no secret key material available to decrypt with %s", kid)}
+	}
+	kgp, ok := GenericKey(pgp).(keygripProvider)
+	if !ok {
+		return nil, KeyFamilyError{fmt.Sprintf("no keygrip available for %s; gpg-agent can only be reached with the real keygrip (see NewPGPAgentSigner)", kid)}
+	}
+	return NewPGPAgentSigner(pgp, kgp.Keygrip())
+}
+
+// PinentryFunc prompts the user for a passphrase (with the given prompt
+// text) when gpg-agent reports it has no cached secret for a key.
+type PinentryFunc func(prompt string) (passphrase string, err error)
+
+// PGPAgentSigner signs delegation statements and decrypts ciphertext by
+// talking the Assuan protocol to a running gpg-agent, for PGP keys whose
+// secret material Keybase never loads into its own process memory.
+type PGPAgentSigner struct {
+	pgp     *PGPKeyBundle
+	keygrip []byte
+	conn    net.Conn
+	r       *bufio.Reader
+}
+
+// NewPGPAgentSigner connects to $GNUPGHOME/S.gpg-agent (or
+// ~/.gnupg/S.gpg-agent) and prepares to sign with pgp's secret key via
+// SIGKEY/PKSIGN, using keygrip as the key identifier gpg-agent expects --
+// the 20-byte value `gpg --list-keys --with-keygrip` reports for pgp,
+// not anything derived from its fingerprint. Passing the wrong keygrip
+// just gets SIGKEY rejected by the agent; there's no silent fallback.
+func NewPGPAgentSigner(pgp *PGPKeyBundle, keygrip []byte) (*PGPAgentSigner, error) {
+	if len(keygrip) == 0 {
+		return nil, KeyFamilyError{"NewPGPAgentSigner: no keygrip provided"}
+	}
+	sockPath, err := gpgAgentSocketPath()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.Dial("unix", sockPath)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to gpg-agent at %s: %s", sockPath, err)
+	}
+	s := &PGPAgentSigner{
+		pgp:     pgp,
+		keygrip: keygrip,
+		conn:    conn,
+		r:       bufio.NewReader(conn),
+	}
+	if _, err := s.readLine(); err != nil { // consume the initial "OK Pleased to meet you" banner
+		conn.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func gpgAgentSocketPath() (string, error) {
+	if home := os.Getenv("GNUPGHOME"); home != "" {
+		return filepath.Join(home, "S.gpg-agent"), nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".gnupg", "S.gpg-agent"), nil
+}
+
+// Sign signs data with no passphrase fallback; use SignWithPinentry if
+// gpg-agent might need to prompt for one.
+func (s *PGPAgentSigner) Sign(data []byte) ([]byte, error) {
+	return s.SignWithPinentry(data, nil)
+}
+
+// SignWithPinentry signs data via the real Assuan sequence gpg-agent
+// expects: SIGKEY to select the key, SETHASH to hand over the hash
+// algorithm and digest, then a bare PKSIGN. If gpg-agent reports it has
+// no cached secret for the key and pinentry is non-nil, it's called to
+// obtain a passphrase, which is then handed to the agent with
+// PRESET_PASSPHRASE (cache ID, timeout, hex-encoded passphrase) before
+// retrying once.
+func (s *PGPAgentSigner) SignWithPinentry(data []byte, pinentry PinentryFunc) ([]byte, error) {
+	if err := s.command(fmt.Sprintf("SIGKEY %s", hex.EncodeToString(s.keygrip))); err != nil {
+		return nil, err
+	}
+
+	hash := sha256.Sum256(data)
+	if err := s.command(fmt.Sprintf("SETHASH --hash=sha256 %s", hex.EncodeToString(hash[:]))); err != nil {
+		return nil, err
+	}
+
+	sig, err := s.commandExpectData("PKSIGN")
+	if err != nil && pinentry != nil && isNoSecretErr(err) {
+		passphrase, perr := pinentry(fmt.Sprintf("Passphrase needed for PGP key %s", s.pgp.GetFingerprint()))
+		if perr != nil {
+			return nil, perr
+		}
+		cacheID := hex.EncodeToString(s.keygrip)
+		presetCmd := fmt.Sprintf("PRESET_PASSPHRASE %s -1 %s", cacheID, hex.EncodeToString([]byte(passphrase)))
+		if err := s.command(presetCmd); err != nil {
+			return nil, err
+		}
+		sig, err = s.commandExpectData("PKSIGN")
+	}
+	return sig, err
+}
+
+// Decrypt decrypts ciphertext via gpg-agent's SETKEY/PKDECRYPT sequence:
+// SETKEY selects the key by keygrip, then PKDECRYPT prompts the agent to
+// INQUIRE for the ciphertext, which is sent back as "D " lines terminated
+// by END, same as the real gpg-agent wire protocol. PGPAgentSigner
+// implements Decrypter as well as Signer since both share the same
+// connection-and-keygrip setup; see DecrypterFor.
+func (s *PGPAgentSigner) Decrypt(ciphertext []byte) ([]byte, error) {
+	if err := s.command(fmt.Sprintf("SETKEY %s", hex.EncodeToString(s.keygrip))); err != nil {
+		return nil, err
+	}
+	return s.commandSendData("PKDECRYPT", ciphertext)
+}
+
+// Close releases the connection to gpg-agent.
+func (s *PGPAgentSigner) Close() error {
+	return s.conn.Close()
+}
+
+// command sends a single Assuan command and expects a plain "OK".
+func (s *PGPAgentSigner) command(cmd string) error {
+	if _, err := fmt.Fprintf(s.conn, "%s\n", cmd); err != nil {
+		return err
+	}
+	_, err := s.readLine()
+	return err
+}
+
+// commandExpectData sends a single Assuan command and collects any "D "
+// data lines that precede the final "OK".
+func (s *PGPAgentSigner) commandExpectData(cmd string) ([]byte, error) {
+	if _, err := fmt.Fprintf(s.conn, "%s\n", cmd); err != nil {
+		return nil, err
+	}
+	var data []byte
+	for {
+		line, err := s.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(line, "D ") {
+			decoded, err := assuanUnescape(line[2:])
+			if err != nil {
+				return nil, err
+			}
+			data = append(data, decoded...)
+			continue
+		}
+		return data, nil
+	}
+}
+
+// commandSendData sends a single Assuan command, responds to the
+// agent's "INQUIRE CIPHERTEXT" with input as percent-escaped "D " lines
+// followed by END, and collects whatever "D " data lines the agent sends
+// back before the final "OK".
+func (s *PGPAgentSigner) commandSendData(cmd string, input []byte) ([]byte, error) {
+	if _, err := fmt.Fprintf(s.conn, "%s\n", cmd); err != nil {
+		return nil, err
+	}
+	line, err := s.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(line, "INQUIRE") {
+		if _, err := fmt.Fprintf(s.conn, "D %s\nEND\n", assuanEscape(input)); err != nil {
+			return nil, err
+		}
+	}
+	var data []byte
+	for {
+		line, err := s.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(line, "D ") {
+			decoded, err := assuanUnescape(line[2:])
+			if err != nil {
+				return nil, err
+			}
+			data = append(data, decoded...)
+			continue
+		}
+		return data, nil
+	}
+}
+
+// assuanEscape applies the Assuan "D " line percent-escaping to raw
+// input: %, CR, LF, and NUL become %XX so the payload can't be mistaken
+// for protocol framing.
+func assuanEscape(input []byte) string {
+	var b strings.Builder
+	for _, c := range input {
+		switch c {
+		case '%', '\r', '\n', 0:
+			fmt.Fprintf(&b, "%%%02X", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// assuanUnescape reverses the Assuan "D " line percent-escaping: %, CR,
+// LF, and NUL (and any other byte the sender chose to escape) are sent
+// as %XX so that binary payloads like a PKSIGN signature can't be
+// mistaken for protocol framing. Leaving these un-decoded silently
+// corrupts any payload byte that happens to need escaping.
+func assuanUnescape(s string) ([]byte, error) {
+	out := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' {
+			out = append(out, s[i])
+			continue
+		}
+		if i+2 >= len(s) {
+			return nil, KeyFamilyError{"assuan: truncated %XX escape in D line"}
+		}
+		b, err := hex.DecodeString(s[i+1 : i+3])
+		if err != nil {
+			return nil, KeyFamilyError{fmt.Sprintf("assuan: invalid %%XX escape in D line: %s", err)}
+		}
+		out = append(out, b[0])
+		i += 2
+	}
+	return out, nil
+}
+
+// readLine reads Assuan response lines until it finds one a caller
+// actually needs to act on, translating a leading "ERR" into a Go error
+// and returning anything else (a "D " data line, an "INQUIRE", the final
+// "OK") as its raw text. "S " status lines (e.g. KEY_CONSIDERED) and "# "
+// comment lines are real gpg-agent output for ordinary operations --
+// PKSIGN/PKDECRYPT on a smartcard-backed key emits "S PROGRESS" lines
+// mid-operation -- and are silently skipped rather than mistaken for the
+// terminal response, which would leave the real "D "/"OK" unread in the
+// buffered connection to be misparsed as the response to whatever
+// command runs next.
+func (s *PGPAgentSigner) readLine() (string, error) {
+	for {
+		line, err := s.r.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if strings.HasPrefix(line, "S ") || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "ERR") {
+			return "", fmt.Errorf("gpg-agent: %s", line)
+		}
+		return line, nil
+	}
+}
+
+func isNoSecretErr(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "No secret key")
+}
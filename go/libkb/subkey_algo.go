@@ -0,0 +1,152 @@
+package libkb
+
+import "fmt"
+
+// SubkeyAlgo identifies the cryptographic construction an encryption
+// subkey uses.
+type SubkeyAlgo int
+
+const (
+	// SubkeyAlgoNaclBox is the long-standing default: a Curve25519/NaCl
+	// box encryption subkey.
+	SubkeyAlgoNaclBox SubkeyAlgo = iota
+	// SubkeyAlgoXChaCha20Poly1305 is a 24-byte-nonce, 16-byte-tag,
+	// 32-byte-key XChaCha20-Poly1305 AEAD encryption subkey.
+	SubkeyAlgoXChaCha20Poly1305
+)
+
+// subkeyAlgoStrength ranks SubkeyAlgo values from weakest to strongest,
+// so negotiation can prefer the strongest algorithm both sides support.
+// XChaCha20-Poly1305's 24-byte nonce removes NaCl box's reliance on
+// never reusing a (key, nonce) pair, so it ranks above it.
+var subkeyAlgoStrength = map[SubkeyAlgo]int{
+	SubkeyAlgoNaclBox:           0,
+	SubkeyAlgoXChaCha20Poly1305: 1,
+}
+
+// subkeyAlgoProvider is implemented by GenericKey values that know which
+// SubkeyAlgo they are. Keys that don't implement it are treated as
+// SubkeyAlgoNaclBox, matching every encryption subkey that predates this.
+type subkeyAlgoProvider interface {
+	SubkeyAlgo() SubkeyAlgo
+}
+
+func subkeyAlgoOf(key GenericKey) SubkeyAlgo {
+	if p, ok := key.(subkeyAlgoProvider); ok {
+		return p.SubkeyAlgo()
+	}
+	return SubkeyAlgoNaclBox
+}
+
+// NegotiateEncryptionSubkeyAlgo picks the strongest SubkeyAlgo present in
+// both mine and peerAdvertised. An empty peerAdvertised is treated as
+// NaCl-box-only, matching the behavior of a peer that predates
+// XChaCha20-Poly1305 subkey support and never sent an advertised-algo
+// list at all.
+func NegotiateEncryptionSubkeyAlgo(mine, peerAdvertised []SubkeyAlgo) (chosen SubkeyAlgo, found bool) {
+	if len(peerAdvertised) == 0 {
+		peerAdvertised = []SubkeyAlgo{SubkeyAlgoNaclBox}
+	}
+	peerSet := make(map[SubkeyAlgo]bool, len(peerAdvertised))
+	for _, a := range peerAdvertised {
+		peerSet[a] = true
+	}
+	for _, a := range mine {
+		if !peerSet[a] {
+			continue
+		}
+		if !found || subkeyAlgoStrength[a] > subkeyAlgoStrength[chosen] {
+			chosen, found = a, true
+		}
+	}
+	return chosen, found
+}
+
+// CheckNoDowngrade guards against a MITM stripping a stronger algorithm
+// out of peerAdvertised so negotiation settles on a weaker one: it walks
+// signedFamilyAlgos (the subkey algorithms the peer's own signed key
+// family actually vouches for) and fails if any entry stronger than
+// chosen is missing from peerAdvertised -- that's exactly the shape of
+// the attack, since a legitimate peer would always advertise everything
+// its signed family supports. Iterating peerAdvertised instead, as an
+// earlier version of this function did, can never see an algorithm the
+// attacker removed from that very list, so it never caught the attack it
+// was written for.
+func CheckNoDowngrade(chosen SubkeyAlgo, peerAdvertised, signedFamilyAlgos []SubkeyAlgo) error {
+	peerSet := make(map[SubkeyAlgo]bool, len(peerAdvertised))
+	for _, a := range peerAdvertised {
+		peerSet[a] = true
+	}
+	for _, a := range signedFamilyAlgos {
+		if subkeyAlgoStrength[a] <= subkeyAlgoStrength[chosen] {
+			continue
+		}
+		if !peerSet[a] {
+			return BadKeyError{fmt.Sprintf("refusing subkey algo %d: peer's signed key family vouches for stronger algo %d that's missing from its advertised list", chosen, a)}
+		}
+	}
+	return nil
+}
+
+// GetEncryptionSubkeysForDevice returns every active encryption subkey
+// belonging to did's sibkey. Unlike GetEncryptionSubkeyForDevice (which
+// only ever follows the single "last-added subkey" pointer on
+// ComputedKeyInfo), this collects every active subkey whose Parent is
+// the device's sibkey, since a sibkey can now carry both a legacy NaCl
+// box subkey and an XChaCha20-Poly1305 one side by side during a
+// migration.
+func (ckf *ComputedKeyFamily) GetEncryptionSubkeysForDevice(did DeviceID) (ret []GenericKey, err error) {
+	sibkeyKID, err := ckf.getSibkeyKidForDevice(did)
+	if err != nil {
+		return nil, err
+	}
+	if sibkeyKID == nil {
+		return nil, nil
+	}
+	for _, subkey := range ckf.GetAllActiveSubkeys() {
+		info, found := ckf.cki.Infos[subkey.GetKid().ToFOKIDMapKey()]
+		if !found || !info.Parent.Eq(sibkeyKID) {
+			continue
+		}
+		if !CanEncrypt(subkey) {
+			continue
+		}
+		ret = append(ret, subkey)
+	}
+	return ret, nil
+}
+
+// GetEncryptionSubkeyForDeviceNegotiated is GetEncryptionSubkeyForDevice
+// extended with algorithm negotiation: given the peer's advertised
+// SubkeyAlgo set and the algorithms their own signed key family vouches
+// for, it returns the strongest subkey both sides support for did,
+// rejecting the result outright if it looks like a downgrade (see
+// CheckNoDowngrade). When GetEncryptionSubkeysForDevice finds no active
+// encryption subkey for did, it falls back to GetEncryptionSubkeyForDevice;
+// a device with a single legacy subkey still goes through negotiation.
+func (ckf *ComputedKeyFamily) GetEncryptionSubkeyForDeviceNegotiated(did DeviceID, peerAdvertised, signedFamilyAlgos []SubkeyAlgo) (GenericKey, error) {
+	subkeys, err := ckf.GetEncryptionSubkeysForDevice(did)
+	if err != nil {
+		return nil, err
+	}
+	if len(subkeys) == 0 {
+		return ckf.GetEncryptionSubkeyForDevice(did)
+	}
+
+	byAlgo := make(map[SubkeyAlgo]GenericKey, len(subkeys))
+	mine := make([]SubkeyAlgo, 0, len(subkeys))
+	for _, sk := range subkeys {
+		algo := subkeyAlgoOf(sk)
+		byAlgo[algo] = sk
+		mine = append(mine, algo)
+	}
+
+	chosenAlgo, found := NegotiateEncryptionSubkeyAlgo(mine, peerAdvertised)
+	if !found {
+		return nil, BadKeyError{"no mutually-supported encryption subkey algorithm"}
+	}
+	if err := CheckNoDowngrade(chosenAlgo, peerAdvertised, signedFamilyAlgos); err != nil {
+		return nil, err
+	}
+	return byAlgo[chosenAlgo], nil
+}
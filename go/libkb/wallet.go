@@ -0,0 +1,151 @@
+package libkb
+
+import (
+	"crypto/sha256"
+	"math/big"
+
+	"golang.org/x/crypto/ripemd160"
+)
+
+// CryptoCoin describes a cryptocurrency whose addresses can be derived
+// from a wallet-role PGP subkey: the curve its keys live on, and the
+// Base58Check version bytes used for addresses and exported secrets.
+type CryptoCoin struct {
+	Symbol       string
+	CurveOID     string // hex-encoded OpenPGP ECC curve OID
+	VersionByte  byte   // Base58Check version byte for addresses
+	SecretPrefix byte   // Base58Check version byte for exported (WIF) secrets
+}
+
+// CryptoCoins is the registry of coins ComputedKeyFamily knows how to
+// recognize and derive addresses for. New coins on an already-supported
+// curve can be added here without touching any of the derivation logic
+// below.
+var CryptoCoins = map[string]CryptoCoin{
+	"BTC": {Symbol: "BTC", CurveOID: "2b8104000a", VersionByte: 0x00, SecretPrefix: 0x80},
+	"LTC": {Symbol: "LTC", CurveOID: "2b8104000a", VersionByte: 0x30, SecretPrefix: 0xb0},
+}
+
+func cryptoCoinForOID(oid string) (CryptoCoin, bool) {
+	for _, c := range CryptoCoins {
+		if c.CurveOID == oid {
+			return c, true
+		}
+	}
+	return CryptoCoin{}, false
+}
+
+// eccOIDProvider is implemented by GenericKey values that know the
+// ASN.1 object identifier of the elliptic curve they were generated on
+// (hex-encoded, as it appears in the OpenPGP ECC public key packet),
+// plus the SEC1-compressed public point. PGP subkeys generated on a
+// named curve such as secp256k1 implement this so ComputedKeyFamily can
+// recognize wallet subkeys without reaching into PGP packet structure
+// itself.
+type eccOIDProvider interface {
+	CurveOIDHex() string
+	ECPublicKeyBytes() []byte
+}
+
+// WalletKey is a resolved wallet-role subkey: its KID, the coin it was
+// derived for, and the address computed from its public point.
+type WalletKey struct {
+	KID     KID
+	Coin    string
+	Address string
+}
+
+// isWalletSubkey reports whether kid names a key whose curve OID is in
+// CryptoCoins -- i.e. a subkey that's a cryptocurrency wallet key
+// rather than an encryption or signing subkey.
+func (ckf ComputedKeyFamily) isWalletSubkey(kid KID) bool {
+	key, err := ckf.kf.FindKeyWithKIDUnsafe(kid)
+	if err != nil {
+		return false
+	}
+	ecc, ok := key.(eccOIDProvider)
+	if !ok {
+		return false
+	}
+	_, found := cryptoCoinForOID(ecc.CurveOIDHex())
+	return found
+}
+
+// GetActiveWalletKeys returns every active wallet-role subkey for the
+// given coin symbol (e.g. "BTC"), along with the Base58Check address
+// each one derives. Inactive (expired or revoked) subkeys are omitted,
+// matching the other GetAllActive* family of methods.
+func (ckf ComputedKeyFamily) GetActiveWalletKeys(coin string) (ret []WalletKey) {
+	c, ok := CryptoCoins[coin]
+	if !ok {
+		return nil
+	}
+	for mapKey, key := range ckf.kf.AllKeys {
+		kid, err := mapKey.ToKID()
+		if err != nil {
+			continue
+		}
+		if ckf.GetKeyRole(kid) != DLGWallet {
+			continue
+		}
+		ecc, ok := key.(eccOIDProvider)
+		if !ok || ecc.CurveOIDHex() != c.CurveOID {
+			continue
+		}
+		addr, err := base58CheckEncode(c.VersionByte, hash160(ecc.ECPublicKeyBytes()))
+		if err != nil {
+			continue
+		}
+		ret = append(ret, WalletKey{KID: kid, Coin: coin, Address: addr})
+	}
+	return
+}
+
+// hash160 computes RIPEMD160(SHA256(b)), the standard Bitcoin-family
+// public key hash.
+func hash160(b []byte) []byte {
+	sh := sha256.Sum256(b)
+	r := ripemd160.New()
+	r.Write(sh[:])
+	return r.Sum(nil)
+}
+
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+// base58CheckEncode produces a Base58Check string: version byte,
+// payload, and a 4-byte checksum taken from the first bytes of
+// double-SHA256(version||payload).
+func base58CheckEncode(version byte, payload []byte) (string, error) {
+	buf := make([]byte, 0, 1+len(payload)+4)
+	buf = append(buf, version)
+	buf = append(buf, payload...)
+
+	h1 := sha256.Sum256(buf)
+	h2 := sha256.Sum256(h1[:])
+	buf = append(buf, h2[:4]...)
+
+	// Count leading zero bytes; each becomes a leading '1' in the
+	// output, same as Bitcoin's address encoding.
+	nZeros := 0
+	for nZeros < len(buf) && buf[nZeros] == 0 {
+		nZeros++
+	}
+
+	x := new(big.Int).SetBytes(buf)
+	mod := big.NewInt(58)
+	zero := big.NewInt(0)
+	var out []byte
+	for x.Cmp(zero) > 0 {
+		var rem big.Int
+		x.DivMod(x, mod, &rem)
+		out = append(out, base58Alphabet[rem.Int64()])
+	}
+	for i := 0; i < nZeros; i++ {
+		out = append(out, base58Alphabet[0])
+	}
+	// out was built least-significant-digit first; reverse it.
+	for l, r := 0, len(out)-1; l < r; l, r = l+1, r-1 {
+		out[l], out[r] = out[r], out[l]
+	}
+	return string(out), nil
+}